@@ -1,7 +1,7 @@
 package cube
 
 import (
-	"log"
+	"fmt"
 	"reflect"
 	"time"
 )
@@ -30,27 +30,48 @@ type Cube struct {
 	store      map[Dimensions]Aggregates
 }
 
-func validateDimensions(dim Dimensions) {
+// DefinitionError is a dimensions or aggregates struct that can't be used in a cube
+type DefinitionError struct {
+	Type  reflect.Type
+	Field string
+	Msg   string
+}
+
+func (e *DefinitionError) Error() string {
+	return fmt.Sprintf("%v has a %s field %s, which is not allowed", e.Type, e.Msg, e.Field)
+}
+
+func validateDimensions(dim Dimensions) error {
 	d := reflect.ValueOf(dim)
 	for i := 0; i < d.NumField(); i++ {
 		if d.Field(i).Type().Kind() == reflect.Ptr {
-			log.Fatal(d.Type(), " has a pointer field ", d.Type().Field(i).Name, " , which is not allowed in a dimension definition")
+			return &DefinitionError{d.Type(), d.Type().Field(i).Name, "pointer"}
 		}
 	}
+	return nil
 }
 
-func validateAggregates(agg Aggregates) {
+func validateAggregates(agg Aggregates) error {
 	a := reflect.ValueOf(agg)
 	for i := 0; i < a.NumField(); i++ {
 		if !a.Field(i).CanInterface() {
-			log.Fatal(a.Type(), " is an aggregates struct with a unexported (lower case name) field ", a.Type().Field(i).Name, " , which is not allowed")
+			return &DefinitionError{a.Type(), a.Type().Field(i).Name, "unexported (lower case name)"}
 		}
 	}
+	return nil
+}
+
+func NewCube(dimensions Dimensions, aggregates Aggregates) (*Cube, error) {
+	if err := validateDimensions(dimensions); err != nil {
+		return nil, err
+	}
+	if err := validateAggregates(aggregates); err != nil {
+		return nil, err
+	}
+	return newCube(dimensions, aggregates), nil
 }
 
-func NewCube(dimensions Dimensions, aggregates Aggregates) *Cube {
-	validateDimensions(dimensions)
-	validateAggregates(aggregates)
+func newCube(dimensions Dimensions, aggregates Aggregates) *Cube {
 	st := make(map[Dimensions]Aggregates)
 	return &Cube{dimensions, aggregates, st}
 }
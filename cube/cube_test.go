@@ -1,7 +1,10 @@
 package cube
 
 import (
+	"errors"
+	"github.com/cloudflare/go-stream/stream"
 	"testing"
+	"time"
 )
 
 func TestInsert(t *testing.T) {
@@ -33,3 +36,126 @@ func TestInsert(t *testing.T) {
 	}
 
 }
+
+type timeTestDimensions struct {
+	T  TimeDimension `db:"t"`
+	D1 IntDimension  `db:"d1"`
+}
+
+func (d timeTestDimensions) TimeIndex() time.Time {
+	return time.Time(d.T)
+}
+
+func insertAt(t *testing.T, c *TimePartitionedCube, sec int) bool {
+	d := timeTestDimensions{*NewTimeDimension(time.Unix(int64(sec), 0)), *NewIntDimension(1)}
+	inserted, err := c.InsertOrLate(d, TestCubeAggregates{NewCountAggregate(1), NewCountAggregate(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inserted
+}
+
+func TestTimePartitionedCubeWatermark(t *testing.T) {
+	c := NewTimePartitionedCube(10 * time.Second).SetMaxLateness(5 * time.Second)
+	insertAt(t, c, 1)
+	insertAt(t, c, 12)
+	if f := c.FlushItems(); f.HasItems() {
+		t.Fatal("Watermark at 7s should not flush [0, 10)")
+	}
+
+	insertAt(t, c, 3) //out of order but within the max lateness
+	insertAt(t, c, 16)
+	if f := c.FlushItems(); f.NumPartitions() != 1 || c.NumPartitions() != 1 {
+		t.Fatal("Expected [0, 10) to be flushed, got ", f.NumPartitions())
+	}
+
+	if insertAt(t, c, 4) {
+		t.Error("Tuple of a flushed partition should be late")
+	}
+	c.SetReopen(true)
+	if !insertAt(t, c, 4) || c.NumPartitions() != 2 {
+		t.Error("Reopen should re-create the flushed partition")
+	}
+	if f := c.FlushItems(); f.NumPartitions() != 1 {
+		t.Error("Re-opened partition should be flushed again, got ", f.NumPartitions())
+	}
+}
+
+func TestTimePartitionedCubeCutoff(t *testing.T) {
+	c := NewTimePartitionedCube(10 * time.Second)
+	insertAt(t, c, 1)
+	insertAt(t, c, 12)
+	if f := c.FlushItems(); f.NumPartitions() != 2 || c.HasItems() {
+		t.Fatal("Without a max lateness, partitions starting before the max time seen should be flushed, got ", f.NumPartitions())
+	}
+	if !insertAt(t, c, 4) {
+		t.Error("Without a max lateness no tuple is late")
+	}
+	if f := c.FlushItems(); f.NumPartitions() != 1 {
+		t.Error("Expected the partition to be flushed again, got ", f.NumPartitions())
+	}
+}
+
+type pointerDimensions struct {
+	D1 *IntDimension
+}
+
+func TestDefinitionErrors(t *testing.T) {
+	var defErr *DefinitionError
+	if _, err := NewCube(pointerDimensions{}, TestCubeAggregates{}); !errors.As(err, &defErr) || defErr.Field != "D1" {
+		t.Error("Expected a definition error on D1, got ", err)
+	}
+
+	var granErr *GranularityError
+	if _, err := NewTimeRepartitionedCube(time.Hour, time.Minute); !errors.As(err, &granErr) {
+		t.Error("Expected a granularity error, got ", err)
+	}
+	if _, err := NewTimeRepartitionedCube(time.Minute, 90*time.Second); !errors.As(err, &granErr) {
+		t.Error("Expected a granularity error, got ", err)
+	}
+	if _, err := NewTimeRepartitionedCube(time.Second, time.Hour); err != nil {
+		t.Error(err)
+	}
+
+	pc := NewPartitionedCube(func(Dimensions) Partition { return 1 })
+	if err := pc.AddPartition(1, NewTestCube()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.AddPartition(1, NewTestCube()); err != ErrOverlappingPartition {
+		t.Error("Expected an overlapping partition error, got ", err)
+	}
+
+	//a merge adds all the partitions or none
+	update := NewPartitionedCube(func(Dimensions) Partition { return 1 })
+	update.AddPartition(1, NewTestCube())
+	update.AddPartition(2, NewTestCube())
+	update.AddPartition(3, NewTestCube())
+	if err := pc.Merge(update); err != ErrOverlappingPartition || len(pc.cubes) != 1 {
+		t.Error("Expected an overlapping partition error and no partition added, got ", err, len(pc.cubes))
+	}
+}
+
+type pointerTimeDimensions struct {
+	T  TimeDimension
+	D1 *IntDimension
+}
+
+func (d pointerTimeDimensions) TimeIndex() time.Time {
+	return time.Time(d.T)
+}
+
+func TestContainerDefinitionError(t *testing.T) {
+	cont, err := NewTimePartitionedCubeContainer(func(obj stream.Object) (Dimensions, Aggregates) {
+		return pointerTimeDimensions{*NewTimeDimension(time.Unix(1, 0)), NewIntDimension(1)}, TestCubeAggregates{}
+	}, time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := stream.NewBatchOperator("DefinitionError", cont, stream.NewNonBlockingProcessedNotifier(1))
+	op.In() <- 1
+	close(op.In())
+	var defErr *DefinitionError
+	if err := op.Run(); !errors.As(err, &defErr) {
+		t.Error("Expected the batcher to fail with a definition error, got ", err)
+	}
+}
@@ -1,7 +1,9 @@
 package cube
 
 import (
+	"github.com/cloudflare/golog/logger"
 	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/util/slog"
 	//	"reflect"
 	"time"
 )
@@ -11,23 +13,98 @@ type TimePartitionedCubeContainer struct {
 	parse             func(stream.Object) (Dimensions, Aggregates)
 	batchGranularity  time.Duration
 	outputGranularity time.Duration
+	watermark         bool
+	late              func(stream.Object)
+	err               error
 }
 
-func (cont *TimePartitionedCubeContainer) Flush(outch chan<- stream.Object) bool {
-	out := NewTimeRepartitionedCube(cont.batchGranularity, cont.outputGranularity)
-	out.Add(cont.cube)
+// NewTimePartitionedCubeContainer returns a *GranularityError unless outputGranularity is a multiple of batchGranularity
+func NewTimePartitionedCubeContainer(parse func(stream.Object) (Dimensions, Aggregates), batchGranularity time.Duration, outputGranularity time.Duration) (*TimePartitionedCubeContainer, error) {
+	if err := checkRepartition(batchGranularity, outputGranularity); err != nil {
+		return nil, err
+	}
+	return &TimePartitionedCubeContainer{NewTimePartitionedCube(batchGranularity), parse, batchGranularity, outputGranularity, false, nil, nil}, nil
+}
+
+// repartition sends the partitions of cube in a cube with the output granularity. Nothing is sent if
+// that fails, the error is kept for Err.
+func (cont *TimePartitionedCubeContainer) repartition(cube PartitionVisitor, outch chan<- stream.Object) bool {
+	out := newTimeRepartitionedCube(cont.batchGranularity, cont.outputGranularity)
+	if err := out.Add(cube); err != nil {
+		slog.Logf(logger.Levels.Error, "Repartitioning flushed cube: %v", err)
+		cont.fail(err)
+		return false
+	}
 	outch <- out
-	cont.cube = NewTimePartitionedCube(cont.batchGranularity)
 	return true
 }
 
+func (cont *TimePartitionedCubeContainer) fail(err error) {
+	if cont.err == nil {
+		cont.err = err
+	}
+}
+
+// Err returns the first tuple that could not be inserted or flush that failed, which fails the batcher
+func (cont *TimePartitionedCubeContainer) Err() error {
+	return cont.err
+}
+
+// SetMaxLateness makes Flush only send the partitions older than the watermark, the max time seen minus d,
+// instead of the whole cube. Tuples of partitions already sent are late.
+func (cont *TimePartitionedCubeContainer) SetMaxLateness(d time.Duration) *TimePartitionedCubeContainer {
+	cont.watermark = true
+	cont.cube.SetMaxLateness(d)
+	return cont
+}
+
+// SetLateOutput sets the side output of late tuples, which are dropped otherwise
+func (cont *TimePartitionedCubeContainer) SetLateOutput(late func(stream.Object)) *TimePartitionedCubeContainer {
+	cont.late = late
+	return cont
+}
+
+// SetReopen inserts late tuples in their partition again, the partition is sent by the next flush
+// and merged with the rows sent before by the upsert
+func (cont *TimePartitionedCubeContainer) SetReopen(reopen bool) *TimePartitionedCubeContainer {
+	cont.cube.SetReopen(reopen)
+	return cont
+}
+
+func (cont *TimePartitionedCubeContainer) Flush(outch chan<- stream.Object) bool {
+	if cont.watermark {
+		flush := cont.cube.FlushItems()
+		if !flush.HasItems() {
+			return false
+		}
+		return cont.repartition(flush, outch)
+	}
+
+	sent := cont.repartition(cont.cube, outch)
+	cont.cube = NewTimePartitionedCube(cont.batchGranularity)
+	return sent
+}
+
 func (cont *TimePartitionedCubeContainer) Add(obj stream.Object) {
 	d, a := cont.parse(obj)
-	cont.cube.Insert(d, a)
+	inserted, err := cont.cube.InsertOrLate(d, a)
+	if err != nil {
+		cont.fail(err)
+		return
+	}
+	if !inserted && cont.late != nil {
+		cont.late(obj)
+	}
 }
 
 func (cont *TimePartitionedCubeContainer) FlushAll(outch chan<- stream.Object) bool {
-	return cont.Flush(outch)
+	if !cont.watermark {
+		return cont.Flush(outch)
+	}
+	//sends the partitions the watermark has not reached yet too, keeping track of the flushed ones
+	sent := cont.repartition(cont.cube, outch)
+	cont.cube.PartitionedCube = NewPartitionedCube(timePartitioner(cont.batchGranularity))
+	return sent
 }
 
 func (cont *TimePartitionedCubeContainer) HasItems() bool {
@@ -38,7 +115,7 @@ func NewPgBatchOperator(parse func(stream.Object) (Dimensions, Aggregates),
 	downstreamProcessed stream.ProcessedNotifier) stream.Operator {
 	batchGran := time.Second
 	outGran := time.Hour
-	cont := &TimePartitionedCubeContainer{NewTimePartitionedCube(batchGran), parse, batchGran, outGran}
+	cont := &TimePartitionedCubeContainer{NewTimePartitionedCube(batchGran), parse, batchGran, outGran, false, nil, nil}
 	return stream.NewBatchOperator("PgBatchOp", cont, downstreamProcessed)
 
 }
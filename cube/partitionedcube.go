@@ -1,10 +1,24 @@
 package cube
 
 import (
-	"log"
+	"errors"
+	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util/slog"
 	"time"
 )
 
+var ErrOverlappingPartition = errors.New("Cannot merge overlapping partition cubes")
+
+// GranularityError is a repartitioning to a granularity that is finer than or not a multiple of the original one
+type GranularityError struct {
+	From time.Duration
+	To   time.Duration
+}
+
+func (e *GranularityError) Error() string {
+	return "Can't repartition " + e.From.String() + " partitions to " + e.To.String() + ", the granularity has to be a coarser multiple"
+}
+
 type Partition interface{}
 
 type PartitionedCube struct {
@@ -16,29 +30,51 @@ func NewPartitionedCube(partitioner func(Dimensions) Partition) *PartitionedCube
 	return &PartitionedCube{partitioner, make(map[Partition]Cuber)}
 }
 
-func (c *PartitionedCube) Insert(dimensions Dimensions, aggregates Aggregates) {
+// InsertErr inserts a tuple, returning a *DefinitionError if its partition is new and the tuple can't
+// be used in a cube
+func (c *PartitionedCube) InsertErr(dimensions Dimensions, aggregates Aggregates) error {
 	p := c.partitioner(dimensions)
 
 	cuber, ok := c.cubes[p]
 	if !ok {
-		cuber = NewCube(dimensions, aggregates)
+		cube, err := NewCube(dimensions, aggregates)
+		if err != nil {
+			return err
+		}
+		cuber = cube
 		c.cubes[p] = cuber
 	}
 	cuber.Insert(dimensions, aggregates)
+	return nil
+}
+
+// Insert implements Cuber, the tuples InsertErr fails on are logged and dropped
+func (c *PartitionedCube) Insert(dimensions Dimensions, aggregates Aggregates) {
+	if err := c.InsertErr(dimensions, aggregates); err != nil {
+		slog.Logf(logger.Levels.Error, "Dropping tuple: %v", err)
+	}
 }
 
-func (c *PartitionedCube) AddPartition(p Partition, upc Cuber) {
+func (c *PartitionedCube) AddPartition(p Partition, upc Cuber) error {
 	_, ok := c.cubes[p]
 	if ok {
-		log.Fatal("Cannot merge overlapping partition cubes")
+		return ErrOverlappingPartition
 	}
 	c.cubes[p] = upc
+	return nil
 }
 
-func (c *PartitionedCube) Merge(update *PartitionedCube) {
+// Merge adds the partitions of update. Nothing is added if c already has one of them.
+func (c *PartitionedCube) Merge(update *PartitionedCube) error {
+	for p := range update.cubes {
+		if _, ok := c.cubes[p]; ok {
+			return ErrOverlappingPartition
+		}
+	}
 	for p, upc := range update.cubes {
-		c.AddPartition(p, upc)
+		c.cubes[p] = upc
 	}
+	return nil
 }
 
 func (c *PartitionedCube) Visit(visitor func(Dimensions, Aggregates)) {
@@ -61,7 +97,7 @@ type PartitionVisitor interface {
 type RepartitionableCube interface {
 	Cuber
 	PartitionVisitor
-	AddPartition(Partition, Cuber)
+	AddPartition(Partition, Cuber) error
 }
 
 type RepartitionedCube struct {
@@ -84,14 +120,18 @@ func (c *RepartitionedCube) getPartitionedCube(outerpart Partition) Repartitiona
 	return outercube
 }
 
-func (c *RepartitionedCube) Add(p PartitionVisitor) {
+// Add adds the partitions of p, returning an error if some were already there
+func (c *RepartitionedCube) Add(p PartitionVisitor) error {
+	errs := make([]error, 0)
 	visitor := func(innerpart Partition, upc Cuber) {
 		outerpart := c.outerpartitioner(innerpart)
 		innercube := c.getPartitionedCube(outerpart)
-		innercube.AddPartition(innerpart, upc)
+		if err := innercube.AddPartition(innerpart, upc); err != nil {
+			errs = append(errs, err)
+		}
 	}
 	p.VisitPartitions(visitor)
-
+	return errors.Join(errs...)
 }
 
 func (c *RepartitionedCube) VisitPartitions(visitor func(Partition, Cuber)) {
@@ -127,7 +167,11 @@ func (tp *TimePartition) Duration() time.Duration {
 type TimePartitionedCube struct {
 	*PartitionedCube
 	dur              time.Duration
-	flushCuttoffTime time.Time
+	flushCuttoffTime time.Time //max time seen
+	maxLateness      time.Duration
+	watermark        bool      //set by SetMaxLateness
+	flushedUntil     time.Time //partitions ending at or before were flushed
+	reopen           bool
 }
 
 func timePartitioner(td time.Duration) func(Dimensions) Partition {
@@ -140,15 +184,55 @@ func timePartitioner(td time.Duration) func(Dimensions) Partition {
 func NewTimePartitionedCube(td time.Duration) *TimePartitionedCube {
 	partitioner := timePartitioner(td)
 
-	return &TimePartitionedCube{NewPartitionedCube(partitioner), td, time.Unix(0, 0)}
+	return &TimePartitionedCube{NewPartitionedCube(partitioner), td, time.Unix(0, 0), 0, false, time.Unix(0, 0), false}
 }
 
-func (c *TimePartitionedCube) Insert(dimensions Dimensions, aggregates Aggregates) {
+// SetMaxLateness keeps the watermark d behind the max time seen, FlushItems only flushes partitions
+// ending before the watermark
+func (c *TimePartitionedCube) SetMaxLateness(d time.Duration) *TimePartitionedCube {
+	c.maxLateness = d
+	c.watermark = true
+	return c
+}
+
+// SetReopen accepts tuples of partitions already flushed, their partition is re-created and flushed again
+// so that it can be merged with what was flushed before (e.g. by the upsert in Postgres).
+func (c *TimePartitionedCube) SetReopen(reopen bool) *TimePartitionedCube {
+	c.reopen = reopen
+	return c
+}
+
+func (c *TimePartitionedCube) Watermark() time.Time {
+	return c.flushCuttoffTime.Add(-c.maxLateness)
+}
+
+// IsLate is true for tuples of partitions already flushed by FlushItems
+func (c *TimePartitionedCube) IsLate(dimensions Dimensions) bool {
+	t := dimensions.(TimeIndexedDimensions).TimeIndex()
+	return t.Before(c.flushedUntil)
+}
+
+func (c *TimePartitionedCube) InsertErr(dimensions Dimensions, aggregates Aggregates) error {
 	t := dimensions.(TimeIndexedDimensions).TimeIndex()
 	if t.Unix() > c.flushCuttoffTime.Unix() {
 		c.flushCuttoffTime = t
 	}
-	c.PartitionedCube.Insert(dimensions, aggregates)
+	return c.PartitionedCube.InsertErr(dimensions, aggregates)
+}
+
+func (c *TimePartitionedCube) Insert(dimensions Dimensions, aggregates Aggregates) {
+	if err := c.InsertErr(dimensions, aggregates); err != nil {
+		slog.Logf(logger.Levels.Error, "Dropping tuple: %v", err)
+	}
+}
+
+// InsertOrLate inserts the tuple unless it is late and re-opening flushed partitions is disabled,
+// in which case it returns false and the tuple is left to the caller.
+func (c *TimePartitionedCube) InsertOrLate(dimensions Dimensions, aggregates Aggregates) (bool, error) {
+	if !c.reopen && c.IsLate(dimensions) {
+		return false, nil
+	}
+	return true, c.InsertErr(dimensions, aggregates)
 }
 
 func (c *TimePartitionedCube) PopTopPartition() (Partition, Cuber) {
@@ -169,18 +253,38 @@ func (c *TimePartitionedCube) PopTopPartition() (Partition, Cuber) {
 	return maxk, retc
 }
 
+// FlushItems removes and returns the partitions ending at or before the watermark. Tuples
+// inserted after that for those partitions are late.
+// Without SetMaxLateness, it flushes the partitions starting before the cutoff time, the max time seen,
+// and moves the cutoff a second ahead on every call; no tuple is late.
 func (c *TimePartitionedCube) FlushItems() *TimePartitionedCube {
 	flush := NewTimePartitionedCube(c.dur)
+	if !c.watermark {
+		for tp, cube := range c.cubes {
+			if tpc, ok := tp.(TimePartition); ok {
+				if tpc.t.Unix() < c.flushCuttoffTime.Unix() {
+					flush.cubes[tp] = cube
+					delete(c.cubes, tp)
+				}
+			}
+		}
+		c.flushCuttoffTime = c.flushCuttoffTime.Add(time.Second)
+		return flush
+	}
+
+	watermark := c.Watermark()
 
 	for tp, cube := range c.cubes {
 		if tpc, ok := tp.(TimePartition); ok {
-			if tpc.t.Unix() < c.flushCuttoffTime.Unix() {
-				flush.AddPartition(tp, cube)
+			if !tpc.t.Add(tpc.td).After(watermark) {
+				flush.cubes[tp] = cube
 				delete(c.cubes, tp)
 			}
 		}
 	}
-	c.flushCuttoffTime = c.flushCuttoffTime.Add(time.Second)
+	if until := watermark.Truncate(c.dur); until.After(c.flushedUntil) {
+		c.flushedUntil = until
+	}
 	return flush
 }
 
@@ -197,14 +301,21 @@ type TimeRepartitionedCube struct {
 	dur time.Duration
 }
 
-func NewTimeRepartitionedCube(originaltd time.Duration, newtd time.Duration) *TimeRepartitionedCube {
-	if originaltd.Seconds() > newtd.Seconds() {
-		log.Fatal("Can't repartition to finer granularity")
+func checkRepartition(originaltd time.Duration, newtd time.Duration) error {
+	if originaltd <= 0 || newtd < originaltd || newtd%originaltd != 0 {
+		return &GranularityError{originaltd, newtd}
 	}
-	if int64(newtd.Seconds())%int64(originaltd.Seconds()) != 0 {
-		log.Fatal("Granularity has to be divisible")
+	return nil
+}
+
+func NewTimeRepartitionedCube(originaltd time.Duration, newtd time.Duration) (*TimeRepartitionedCube, error) {
+	if err := checkRepartition(originaltd, newtd); err != nil {
+		return nil, err
 	}
+	return newTimeRepartitionedCube(originaltd, newtd), nil
+}
 
+func newTimeRepartitionedCube(originaltd time.Duration, newtd time.Duration) *TimeRepartitionedCube {
 	outer := func(inner Partition) (outer Partition) {
 		tp := inner.(TimePartition)
 		return TimePartition{tp.t.Truncate(newtd), newtd}
@@ -2,6 +2,7 @@ package pg
 
 import (
 	"database/sql/driver"
+	"fmt"
 	"github.com/cevian/pq"
 	"github.com/cloudflare/golog/logger"
 	"reflect"
@@ -9,6 +10,29 @@ import (
 	"github.com/cloudflare/go-stream/util/slog"
 )
 
+// UpsertError is a failed step of UpsertCubes, after which the transaction is rolled back
+type UpsertError struct {
+	Step string
+	Err  error
+}
+
+func (e *UpsertError) Error() string {
+	return fmt.Sprintf("Error %s: %v", e.Step, e.Err)
+}
+
+func (e *UpsertError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownPartitionError is a cube partition with no table partition counterpart
+type UnknownPartitionError struct {
+	Type reflect.Type
+}
+
+func (e *UnknownPartitionError) Error() string {
+	return fmt.Sprintf("Unknown Partition Type %v", e.Type)
+}
+
 type Executor struct {
 	table *Table
 	conn  driver.Conn
@@ -26,7 +50,7 @@ func (e *Executor) ExecErr(sql string, args ...interface{}) (driver.Result, erro
 		var err error
 		dargs[n], err = driver.DefaultParameterConverter.ConvertValue(arg)
 		if err != nil {
-			slog.Fatalf("sql: converting Exec argument #%d's type: %v", n, err)
+			return nil, fmt.Errorf("sql: converting Exec argument #%d's type: %w", n, err)
 		}
 	}
 	return exec.Exec(sql, dargs)
@@ -64,59 +88,80 @@ func (e *Executor) DropForeignTableView() {
 	e.Exec(e.table.DropForeignTableViewSql())
 }
 
-func getPartition(p cube.Partition) Partition {
+func getPartition(p cube.Partition) (Partition, error) {
 	switch pt := p.(type) {
 	case cube.TimePartition:
-		return &TimePartition{&pt}
+		return &TimePartition{&pt}, nil
 	default:
-		slog.Fatalf("Unknown Partition Type %v", reflect.TypeOf(pt))
+		return nil, &UnknownPartitionError{reflect.TypeOf(pt)}
 	}
-	panic("Never Here")
 }
 
-func (e *Executor) DropPartition(p cube.Partition) {
-	e.Exec(e.table.DropPartitionTableSql(getPartition(p)))
+func (e *Executor) DropPartition(p cube.Partition) error {
+	part, err := getPartition(p)
+	if err != nil {
+		return err
+	}
+	if _, err := e.ExecErr(e.table.DropPartitionTableSql(part)); err != nil {
+		return fmt.Errorf("Error dropping partition: %w", err)
+	}
+	return nil
 }
 
-func (e *Executor) UpsertCube(p cube.Partition, c cube.Cuber) {
-	e.UpsertCubes(p, []cube.Cuber{c})
+func (e *Executor) UpsertCube(p cube.Partition, c cube.Cuber) error {
+	return e.UpsertCubes(p, []cube.Cuber{c})
 }
 
-func (e *Executor) UpsertCubes(p cube.Partition, c []cube.Cuber) {
-	tx, err := e.conn.Begin()
+func (e *Executor) UpsertCubes(p cube.Partition, c []cube.Cuber) error {
+	part, err := getPartition(p)
 	if err != nil {
-		slog.Fatalf("Error starting transaction %v", err)
+		return err
 	}
 
-	part := getPartition(p)
+	tx, err := e.conn.Begin()
+	if err != nil {
+		return &UpsertError{"starting transaction", err}
+	}
+	failed := func(step string, err error) error {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			slog.Logf(logger.Levels.Error, "Error rolling back tx %v", rbErr)
+		}
+		return &UpsertError{step, err}
+	}
 
 	//TODO: have a cache of existing partition tables...dont recreate if not necessary
-	e.Exec(e.table.CreatePartitionTableSql(part))
+	if _, err := e.ExecErr(e.table.CreatePartitionTableSql(part)); err != nil {
+		return failed("creating partition table", err)
+	}
 
-	e.Exec(e.table.CreateTemporaryCopyTableSql(part))
+	if _, err := e.ExecErr(e.table.CreateTemporaryCopyTableSql(part)); err != nil {
+		return failed("creating copy table", err)
+	}
 	cy := pq.NewCopierFromConn(e.conn)
 	err = cy.Start(e.table.CopyTableSql(part))
 	if err != nil {
-		slog.Fatalf("Error starting copy %v", err)
+		return failed("starting copy", err)
 	}
 
 	for _, cube := range c {
 		err = cy.Send(e.table.CopyDataFull(cube))
 		if err != nil {
-			slog.Fatalf("Error copying %v", err)
+			return failed("copying", err)
 		}
 	}
 
 	err = cy.Close()
 	if err != nil {
-		slog.Fatalf("Error Ending Copy %v", err)
+		return failed("ending copy", err)
 	}
 
-	e.Exec(e.table.MergeCopySql(part))
+	if _, err := e.ExecErr(e.table.MergeCopySql(part)); err != nil {
+		return failed("merging copy", err)
+	}
 
 	err = tx.Commit()
 	if err != nil {
-		slog.Fatalf("Error Committing tx %v ", err)
+		return &UpsertError{"committing tx", err}
 	}
-
+	return nil
 }
@@ -9,15 +9,16 @@ import (
 	"log"
 )
 
-func NewUpsertOp(dbconnect string, tableName string, cd cube.CubeDescriber) (stream.Operator, stream.ProcessedNotifier, *Executor) {
+// NewUpsertOp connects to the database and returns the op upserting the cubes it gets into tableName
+func NewUpsertOp(dbconnect string, tableName string, cd cube.CubeDescriber) (stream.Operator, stream.ProcessedNotifier, *Executor, error) {
 	db, err := sql.Open("postgres", dbconnect)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, &UpsertError{"opening database", err}
 	}
 	drv := db.Driver()
 	conn, err := drv.Open(dbconnect)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, &UpsertError{"connecting", err}
 	}
 
 	table := MakeTable(tableName, cd)
@@ -28,20 +29,29 @@ func NewUpsertOp(dbconnect string, tableName string, cd cube.CubeDescriber) (str
 
 	ready := stream.NewNonBlockingProcessedNotifier(2)
 
-	f := func(input stream.Object, out mapper.Outputer) {
+	f := func(input stream.Object, out mapper.Outputer) error {
 		in := input.(*cube.TimeRepartitionedCube)
+		var err error
 		visitor := func(part cube.Partition, c cube.Cuber) {
-			exec.UpsertCube(part, c)
+			if err == nil {
+				err = exec.UpsertCube(part, c)
+			}
 		}
 		in.VisitPartitions(visitor)
+		if err != nil {
+			return err
+		}
 		ready.Notify(1)
+		return nil
 	}
 
 	exit := func() {
 		log.Println("Db Upser Exit: ")
 	}
 
+	//a failed upsert fails the chain, the host decides whether to restart it
 	op := mapper.NewOpExitor(f, exit, "DbUpsert")
 	op.Parallel = false
-	return op, ready, exec
+	op.SetErrorPolicy(mapper.ErrorPolicy{Action: mapper.ERROR_FAIL})
+	return op, ready, exec, nil
 }
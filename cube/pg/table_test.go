@@ -47,7 +47,11 @@ type TestCubeAggregates struct {
 }
 
 func NewTestCube() *cube.Cube {
-	return cube.NewCube(TestCubeDimensions{}, TestCubeAggregates{})
+	c, err := cube.NewCube(TestCubeDimensions{}, TestCubeAggregates{})
+	if err != nil {
+		panic(err)
+	}
+	return c
 }
 
 func InsertTestCube(c *cube.Cube, d1 time.Time, d2 int, A1 int, A2 int) {
@@ -146,12 +150,13 @@ func TestInsertToDb(t *testing.T) {
 	part := cube.NewTimePartition(start, time.Hour)
 
 	exec.CreateBaseTable()
-	exec.DropPartition(part)
-	exec.UpsertCube(part, c)
-
-	checkTable(table, 1, 2, start, t)
-	exec.UpsertCube(part, c)
-	checkTable(table, 2, 4, start, t)
-	exec.UpsertCube(part, c)
-	checkTable(table, 3, 6, start, t)
+	if err := exec.DropPartition(part); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := exec.UpsertCube(part, c); err != nil {
+			t.Fatal(err)
+		}
+		checkTable(table, i, 2*i, start, t)
+	}
 }
@@ -11,7 +11,7 @@ type TestCubeAggregates struct {
 }
 
 func NewTestCube() *Cube {
-	return NewCube(TestCubeDimensions{}, TestCubeAggregates{})
+	return newCube(TestCubeDimensions{}, TestCubeAggregates{})
 }
 
 func InsertTestCube(c *Cube, d1 int, d2 int, A1 int, A2 int) {
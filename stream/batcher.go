@@ -1,11 +1,17 @@
 package stream
 
 import (
+	"errors"
 	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util"
 	"github.com/cloudflare/go-stream/util/slog"
+	"sync/atomic"
 	"time"
 )
 
+// ErrUnflushed is returned by a batcher whose container still has items after its last flush
+var ErrUnflushed = errors.New("Last flush did not empty container, some stuff will never be sent")
+
 type BatchContainer interface {
 	Flush(chan<- Object) bool
 	FlushAll(chan<- Object) bool
@@ -13,6 +19,13 @@ type BatchContainer interface {
 	Add(object Object)
 }
 
+// FallibleContainer is a BatchContainer that can fail to add or flush objects. The batcher returns Err
+// as soon as it is set.
+type FallibleContainer interface {
+	BatchContainer
+	Err() error
+}
+
 type BatcherOperator struct {
 	*HardStopChannelCloser
 	*BaseIn
@@ -26,11 +39,13 @@ type BatcherOperator struct {
 	minWaitForLeftover    time.Duration
 	outstanding           uint
 	total_flushes         uint
+	held                  int64 //items added since the container was last empty
+	metrics               *util.MetricsGroup
 }
 
 func NewBatchOperator(name string, container BatchContainer, processedDownstream ProcessedNotifier) *BatcherOperator {
 	return &BatcherOperator{NewHardStopChannelCloser(), NewBaseIn(CHAN_SLACK), NewBaseOut(CHAN_SLACK), name, container, 1,
-		processedDownstream, time.Second, time.Second, time.Second, 0, 0}
+		processedDownstream, time.Second, time.Second, time.Second, 0, 0, 0, nil}
 }
 
 func (op *BatcherOperator) SetTimeouts(td time.Duration) {
@@ -48,18 +63,47 @@ func (op *BatcherOperator) DownstreamWillCallback() bool {
 	return op.MaxOutstanding != 0 && op.outstanding >= op.MaxOutstanding
 }
 
+func (op *BatcherOperator) SetMetrics(m *util.MetricsGroup) {
+	op.metrics = m
+}
+
 func (op *BatcherOperator) Flush() {
 	op.total_flushes += 1
 	if op.container.Flush(op.Out()) {
 		op.outstanding += 1
+		recordOut(op.metrics, 1)
 	}
+	op.updateHeld()
 }
 
 func (op *BatcherOperator) LastFlush() {
 	op.total_flushes += 1
 	if op.container.FlushAll(op.Out()) {
 		op.outstanding += 1
+		recordOut(op.metrics, 1)
+	}
+	op.updateHeld()
+}
+
+func (op *BatcherOperator) containerErr() error {
+	if fc, ok := op.container.(FallibleContainer); ok {
+		if err := fc.Err(); err != nil {
+			slog.Logf(logger.Levels.Error, "%s: %v", op.name, err)
+			return err
+		}
 	}
+	return nil
+}
+
+func (op *BatcherOperator) updateHeld() {
+	if !op.container.HasItems() {
+		atomic.StoreInt64(&op.held, 0)
+	}
+}
+
+// Pending counts the items in the input channel and the ones added to the container since it was last empty
+func (op *BatcherOperator) Pending() int {
+	return op.GetInDepth() + int(atomic.LoadInt64(&op.held))
 }
 
 func (op *BatcherOperator) Run() error {
@@ -104,7 +148,13 @@ func (op *BatcherOperator) Run() error {
 		//case IN
 		case obj, ok := <-op.In():
 			if ok {
+				start := time.Now()
 				op.container.Add(obj)
+				if err := op.containerErr(); err != nil {
+					return err
+				}
+				atomic.AddInt64(&op.held, 1)
+				recordItem(op.metrics, start)
 				if !op.DownstreamWillCallback() && op.container.HasItems() && batchExpired == nil { //used by first item
 					batchExpired = time.After(op.minWaitAfterFirstItem)
 				}
@@ -113,8 +163,12 @@ func (op *BatcherOperator) Run() error {
 				if op.container.HasItems() {
 					op.LastFlush()
 				}
+				if err := op.containerErr(); err != nil {
+					return err
+				}
 				if op.container.HasItems() {
-					slog.Fatalf("Last flush did not empty container, some stuff will never be sent")
+					slog.Logf(logger.Levels.Error, "%s: %v", op.name, ErrUnflushed)
+					return ErrUnflushed
 				}
 				slog.Logf(logger.Levels.Debug, "Batch Operator ", op.name, " flushed ", op.total_flushes)
 				return nil
@@ -127,6 +181,9 @@ func (op *BatcherOperator) Run() error {
 				op.Flush()
 				batchExpired = time.After(op.minWaitBetweenFlushes)
 			}
+			if err := op.containerErr(); err != nil {
+				return err
+			}
 			if !op.DownstreamWillCallback() && op.container.HasItems() && batchExpired == nil {
 				batchExpired = time.After(op.minWaitForLeftover)
 			}
@@ -141,6 +198,9 @@ func (op *BatcherOperator) Run() error {
 				op.Flush()
 				batchExpired = time.After(op.minWaitBetweenFlushes)
 			}
+			if err := op.containerErr(); err != nil {
+				return err
+			}
 			if !op.DownstreamWillCallback() && op.container.HasItems() && batchExpired == nil {
 				batchExpired = time.After(op.minWaitForLeftover)
 			}
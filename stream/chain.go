@@ -1,16 +1,24 @@
 package stream
 
 import (
+	"context"
+	"errors"
 	"github.com/cloudflare/golog/logger"
 	"github.com/cloudflare/go-stream/util/slog"
+	"time"
 )
 
 type Chain interface {
 	Operators() []Operator
 	Run() error
+	RunContext(ctx context.Context) error
 	Stop() error
 	Add(o Operator) Chain
+	//AddWithBuffer adds o with an output channel of capacity n instead of the chain's default
+	AddWithBuffer(o Operator, n int) Chain
 	SetName(string) Chain
+	//SetBuffer sets the capacity of the channels created by subsequent calls to Add
+	SetBuffer(n int) Chain
 
 	//NewSubChain creates a new empty chain inheriting the properties of the parent chain
 	//Usefull for distribute/fanout building functions
@@ -18,7 +26,9 @@ type Chain interface {
 
 	//async functions
 	Start() error
+	StartContext(ctx context.Context) error
 	Wait() error
+	Drain(timeout time.Duration) ([]Dropped, error)
 }
 
 /* A SimpleChain implements the operator interface too! */
@@ -28,8 +38,11 @@ type SimpleChain struct {
 	//	wg          *sync.WaitGroup
 	//	closenotify chan bool
 	//	closeerror  chan error
-	sentstop bool
-	Name     string
+	sentstop  bool
+	startErr  error
+	buffer    int
+	Name      string
+	unordered []int //operators an OrderedChain could not make ordered, reported by Validate/Start
 }
 
 func NewChain() *SimpleChain {
@@ -37,7 +50,7 @@ func NewChain() *SimpleChain {
 }
 
 func NewSimpleChain() *SimpleChain {
-	return &SimpleChain{runner: NewRunner()}
+	return &SimpleChain{runner: NewRunner(), buffer: CHAN_SLACK}
 }
 
 func (c *SimpleChain) Operators() []Operator {
@@ -49,23 +62,51 @@ func (c *SimpleChain) SetName(name string) Chain {
 	return c
 }
 
+// SetBuffer sets the capacity of the channels connecting the operators added by subsequent calls to Add
+func (c *SimpleChain) SetBuffer(n int) Chain {
+	if n < 0 {
+		slog.Logf(logger.Levels.Error, "Negative buffer %d for chain %s, using %d", n, c.Name, CHAN_SLACK)
+		n = CHAN_SLACK
+	}
+	c.buffer = n
+	return c
+}
+
 func (c *SimpleChain) NewSubChain() Chain {
-	return NewSimpleChain()
+	sub := NewSimpleChain()
+	sub.buffer = c.buffer
+	return sub
 }
 
 func (c *SimpleChain) Add(o Operator) Chain {
+	return c.AddWithBuffer(o, c.buffer)
+}
+
+// AddWithBuffer adds o to the chain. If o has an output, the channel connecting it to the next operator
+// has capacity n.
+func (c *SimpleChain) AddWithBuffer(o Operator, n int) Chain {
+	if n < 0 {
+		slog.Logf(logger.Levels.Error, "Negative buffer %d for %s, using %d", n, Name(o), c.buffer)
+		n = c.buffer
+	}
+
 	ops := c.runner.Operators()
 	if len(ops) > 0 {
-		slog.Logf(logger.Levels.Info, "Setting input channel of %s", Name(o))
-		last := ops[len(ops)-1]
-		lastOutCh := last.(Out).Out()
-		o.(In).SetIn(lastOutCh)
+		//miswired operators are added anyway and reported by Validate/Start
+		last, lastOk := ops[len(ops)-1].(Out)
+		in, inOk := o.(In)
+		if lastOk && inOk {
+			slog.Logf(logger.Levels.Info, "Setting input channel of %s", Name(o))
+			in.SetIn(last.Out())
+		} else {
+			slog.Logf(logger.Levels.Error, "Cannot connect %s to %s", Name(ops[len(ops)-1]), Name(o))
+		}
 	}
 
 	out, ok := o.(Out)
 	if ok {
 		slog.Logf(logger.Levels.Info, "Setting output channel of %s", Name(o))
-		ch := make(chan Object, CHAN_SLACK)
+		ch := make(chan Object, n)
 		out.SetOut(ch)
 	}
 
@@ -73,17 +114,37 @@ func (c *SimpleChain) Add(o Operator) Chain {
 	return c
 }
 
+// Start checks the wiring of the chain (see Validate) and runs all the operators
 func (c *SimpleChain) Start() error {
+	if err := c.checkStart(); err != nil {
+		return err
+	}
 	c.runner.AsyncRunAll()
 	return nil
 }
 
+// StartContext starts the chain and hard stops it once ctx is done.
+func (c *SimpleChain) StartContext(ctx context.Context) error {
+	if err := c.checkStart(); err != nil {
+		return err
+	}
+	c.runner.AsyncRunAllContext(ctx)
+	return nil
+}
+
+func (c *SimpleChain) checkStart() error {
+	c.startErr = errors.Join(validateOps(c.path(), c.Operators(), false, false), c.orderErrors())
+	if c.startErr != nil {
+		slog.Logf(logger.Levels.Error, "Not starting chain: %v", c.startErr)
+	}
+	return c.startErr
+}
+
 func (c *SimpleChain) SoftStop() error {
 	if !c.sentstop {
 		c.sentstop = true
 		slog.Logf(logger.Levels.Warn, "In soft close")
-		ops := c.runner.Operators()
-		ops[0].Stop()
+		c.runner.SoftStop()
 	}
 	return nil
 }
@@ -99,6 +160,9 @@ func (c *SimpleChain) Stop() error {
 }
 
 func (c *SimpleChain) Wait() error {
+	if c.startErr != nil {
+		return c.startErr
+	}
 	slog.Logf(logger.Levels.Info, "Waiting for closenotify %s", c.Name)
 	<-c.runner.CloseNotifier()
 	select {
@@ -110,10 +174,19 @@ func (c *SimpleChain) Wait() error {
 		c.SoftStop()
 	}
 	slog.Logf(logger.Levels.Info, "Waiting for wg")
-	c.runner.WaitGroup().Wait()
+	c.runner.Wait()
 	slog.Logf(logger.Levels.Info, "Exiting SimpleChain")
 
-	return nil
+	return c.runner.Err()
+}
+
+func (c *SimpleChain) Pending() int {
+	return pendingOfAll(c.runner.Operators())
+}
+
+// Errors returns the errors returned by the chain's operators, each wrapped in an *OpError.
+func (c *SimpleChain) Errors() []error {
+	return c.runner.Errors()
 }
 
 /* Operator compatibility */
@@ -124,6 +197,15 @@ func (c *SimpleChain) Run() error {
 	return c.Wait()
 }
 
+// RunContext runs the chain until it closes or ctx is done. The returned error joins the errors
+// of every operator and, if the chain was cancelled, ctx.Err().
+func (c *SimpleChain) RunContext(ctx context.Context) error {
+	if err := c.StartContext(ctx); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
 type OrderedChain struct {
 	*SimpleChain
 }
@@ -133,23 +215,35 @@ func NewOrderedChain() *OrderedChain {
 }
 
 func (c *OrderedChain) Add(o Operator) Chain {
+	return c.AddWithBuffer(o, c.buffer)
+}
+
+func (c *OrderedChain) AddWithBuffer(o Operator, n int) Chain {
 	parallel, ok := o.(ParallelizableOperator)
 	if ok {
 		if !parallel.IsOrdered() {
 			parallel = parallel.MakeOrdered()
 			if !parallel.IsOrdered() {
-				slog.Fatalf("%s", "Couldn't make parallel operator ordered")
+				slog.Logf(logger.Levels.Error, "Couldn't make parallel operator %s ordered", Name(o))
+				c.unordered = append(c.unordered, len(c.Operators()))
 			}
 		}
-		c.SimpleChain.Add(parallel)
+		c.SimpleChain.AddWithBuffer(parallel, n)
 	} else {
-		c.SimpleChain.Add(o)
+		c.SimpleChain.AddWithBuffer(o, n)
 	}
 	return c
 }
 
+func (c *OrderedChain) SetBuffer(n int) Chain {
+	c.SimpleChain.SetBuffer(n)
+	return c
+}
+
 func (c *OrderedChain) NewSubChain() Chain {
-	return NewOrderedChain()
+	sub := NewOrderedChain()
+	sub.buffer = c.buffer
+	return sub
 }
 
 type InChain interface {
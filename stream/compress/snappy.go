@@ -2,19 +2,19 @@ package compress
 
 import (
 	"code.google.com/p/snappy-go/snappy"
-	"log"
 	"github.com/cloudflare/go-stream/stream"
 	"github.com/cloudflare/go-stream/stream/mapper"
 )
 
 func NewSnappyEncodeOp() stream.Operator {
 	generator := func() interface{} {
-		fn := func(in []byte) [][]byte {
-			compressed, err := snappy.Encode(nil, in)
+		fn := func(in stream.Object, out mapper.Outputer) error {
+			compressed, err := snappy.Encode(nil, in.([]byte))
 			if err != nil {
-				log.Printf("Error in snappy compression %v", err)
+				return err
 			}
-			return [][]byte{compressed}
+			out.Out(1) <- compressed
+			return nil
 		}
 		return fn
 	}
@@ -23,12 +23,13 @@ func NewSnappyEncodeOp() stream.Operator {
 
 func NewSnappyDecodeOp() stream.Operator {
 	generator := func() interface{} {
-		fn := func(in []byte) [][]byte {
-			decompressed, err := snappy.Decode(nil, in)
+		fn := func(in stream.Object, out mapper.Outputer) error {
+			decompressed, err := snappy.Decode(nil, in.([]byte))
 			if err != nil {
-				log.Printf("Error in snappy decompression %v", err)
+				return err
 			}
-			return [][]byte{decompressed}
+			out.Out(1) <- decompressed
+			return nil
 		}
 		return fn
 	}
@@ -0,0 +1,205 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Graph is a snapshot of the topology of an operator graph, with the state of the channels between operators
+type Graph struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []*Edge `json:"edges"`
+}
+
+type Node struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`  // source, sink, operator, fanout, distributor, merge or join
+	Chain string `json:"chain"` // path of the chain the operator was added to
+}
+
+// Edge is the channel feeding To from From
+type Edge struct {
+	From     int `json:"from"`
+	To       int `json:"to"`
+	Capacity int `json:"capacity"`
+	Depth    int `json:"depth"`
+}
+
+// Describe walks op, the operators of chains, the branches of fanouts, the branches distributors
+// created so far and the inputs of merges and joins, and returns the graph they form. It is safe to call while the graph is running.
+func Describe(op Operator) *Graph {
+	d := &describer{&Graph{make([]*Node, 0), make([]*Edge, 0)}}
+	d.op("", 0, op)
+	return d.g
+}
+
+type describer struct {
+	g *Graph
+}
+
+func (d *describer) node(chain string, op Operator) int {
+	_, isIn := op.(In)
+	_, isOut := op.(Out)
+	kind := "operator"
+	switch op.(type) {
+	case *FanoutOperator:
+		kind = "fanout"
+	case *DistributeOperator:
+		kind = "distributor"
+	case *MergeOperator:
+		kind = "merge"
+	case *JoinOperator:
+		kind = "join"
+	default:
+		if !isIn {
+			kind = "source"
+		} else if !isOut {
+			kind = "sink"
+		}
+	}
+	id := len(d.g.Nodes)
+	d.g.Nodes = append(d.g.Nodes, &Node{id, Name(op), kind, chain})
+	return id
+}
+
+func (d *describer) edge(from int, to int, op Operator) {
+	if in, ok := op.(In); ok {
+		d.channelEdge(from, to, in.In())
+	}
+}
+
+func (d *describer) channelEdge(from int, to int, ch chan Object) {
+	if ch != nil {
+		d.g.Edges = append(d.g.Edges, &Edge{from, to, cap(ch), len(ch)})
+	}
+}
+
+// op adds op, at index i of the chain at path, to the graph and returns the nodes where it starts and ends
+// so the caller can link them. first is the operator owning the input channel of the start node.
+func (d *describer) op(path string, i int, op Operator) (firstId int, first Operator, lastId int) {
+	if _, isHolder := op.(BranchHolder); !isHolder {
+		if lister, ok := op.(operatorLister); ok {
+			return d.chain(subChainPath(path, op), lister.Operators())
+		}
+	}
+
+	id := d.node(path, op)
+	if holder, ok := op.(BranchHolder); ok {
+		for j, branch := range holder.Branches() {
+			bfId, bf, _ := d.op(fmt.Sprintf("%s[%d]/%d", path, i, j), 0, branch)
+			if bf != nil {
+				d.edge(id, bfId, bf)
+			}
+		}
+	}
+	if merge, ok := op.(*MergeOperator); ok {
+		for j, input := range merge.Inputs() {
+			_, _, lastId := d.op(fmt.Sprintf("%s[%d]/%d", path, i, j), 0, input)
+			if lastId >= 0 {
+				d.channelEdge(lastId, id, merge.inputs[j])
+			}
+		}
+	}
+	if join, ok := op.(*JoinOperator); ok {
+		for j, input := range join.RightInputs() {
+			_, _, lastId := d.op(fmt.Sprintf("%s[%d]/%d", path, i, j), 0, input)
+			if lastId >= 0 {
+				d.channelEdge(lastId, id, join.Right())
+			}
+		}
+	}
+	return id, op, id
+}
+
+func (d *describer) chain(path string, ops []Operator) (firstId int, first Operator, lastId int) {
+	firstId, lastId = -1, -1
+	for i, op := range ops {
+		fId, f, lId := d.op(path, i, op)
+		if i == 0 {
+			firstId, first = fId, f
+		} else if f != nil && lastId >= 0 {
+			d.edge(lastId, fId, f)
+		}
+		lastId = lId
+	}
+	return firstId, first, lastId
+}
+
+// subChainPath is the path of a chain nested in the chain at path. Unnamed chains share the path of their parent.
+func subChainPath(path string, op Operator) string {
+	name := ""
+	switch c := op.(type) {
+	case *inChain:
+		return subChainPath(path, c.Chain)
+	case *SimpleChain:
+		name = c.Name
+	case *OrderedChain:
+		name = c.Name
+	}
+	if path == "" {
+		if name == "" {
+			return "chain"
+		}
+		return name
+	}
+	if name == "" {
+		return path
+	}
+	return path + "/" + name
+}
+
+func (g *Graph) JSON() ([]byte, error) {
+	return json.Marshal(g)
+}
+
+// DOT renders the graph for Graphviz, one cluster per chain. Edges are labelled depth/capacity.
+func (g *Graph) DOT() string {
+	var buf bytes.Buffer
+	buf.WriteString("digraph stream {\n\trankdir=LR;\n")
+
+	chains := make([]string, 0)
+	byChain := make(map[string][]*Node)
+	for _, n := range g.Nodes {
+		if _, ok := byChain[n.Chain]; !ok {
+			chains = append(chains, n.Chain)
+		}
+		byChain[n.Chain] = append(byChain[n.Chain], n)
+	}
+
+	for i, chain := range chains {
+		indent := "\t"
+		if chain != "" {
+			fmt.Fprintf(&buf, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", i, dotQuote(chain))
+			indent = "\t\t"
+		}
+		for _, n := range byChain[chain] {
+			fmt.Fprintf(&buf, "%sn%d [label=%s, shape=%s];\n", indent, n.Id, dotQuote(n.Name), dotShape(n.Kind))
+		}
+		if chain != "" {
+			buf.WriteString("\t}\n")
+		}
+	}
+
+	for _, e := range g.Edges {
+		fmt.Fprintf(&buf, "\tn%d -> n%d [label=\"%d/%d\"];\n", e.From, e.To, e.Depth, e.Capacity)
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+func dotShape(kind string) string {
+	switch kind {
+	case "source", "sink":
+		return "ellipse"
+	case "fanout", "distributor", "merge", "join":
+		return "diamond"
+	}
+	return "box"
+}
+
+func dotQuote(s string) string {
+	return "\"" + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + "\""
+}
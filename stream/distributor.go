@@ -1,9 +1,14 @@
 package stream
 
 import (
+	"container/list"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util"
 	"github.com/cloudflare/go-stream/util/slog"
+	"time"
 )
 
 type DistributorChildOp interface {
@@ -13,61 +18,243 @@ type DistributorChildOp interface {
 
 type DistribKey interface{}
 
+// BranchEviction is the reason a distributor closed a branch before its own input closed
+type BranchEviction int
+
+const (
+	EVICT_IDLE BranchEviction = iota //no object for the idle timeout
+	EVICT_LRU                        //least recently used branch, evicted to stay under the max branch count
+)
+
+type distribBranch struct {
+	key      DistribKey
+	op       DistributorChildOp
+	ch       chan Object
+	lastUsed time.Time
+}
+
 type DistributeOperator struct {
 	*HardStopChannelCloser
 	*BaseIn
 	mapper        func(Object) DistribKey
 	branchCreator func(DistribKey) DistributorChildOp
-	outputs       map[DistribKey]chan<- Object
+	outputs       map[DistribKey]*list.Element //of *distribBranch
+	lru           *list.List                   //most recently used branch first
+	evicted       map[DistribKey]<-chan bool   //closed when the evicted branch of the key exited
 	runner        *Runner
+	buffer        int
+	idleTimeout   time.Duration
+	maxBranches   int
+	onCreate      func(DistribKey, DistributorChildOp)
+	onEvict       func(DistribKey, DistributorChildOp, BranchEviction)
+	strategy      DistributionStrategy //branches are pre-created when set
+	metrics       *util.MetricsGroup
 }
 
 func NewDistributor(mapp func(Object) DistribKey, creator func(DistribKey) DistributorChildOp) *DistributeOperator {
-	return &DistributeOperator{NewHardStopChannelCloser(), NewBaseIn(CHAN_SLACK), mapp, creator, make(map[DistribKey]chan<- Object), NewRunner()}
+	return &DistributeOperator{NewHardStopChannelCloser(), NewBaseIn(CHAN_SLACK), mapp, creator, make(map[DistribKey]*list.Element), list.New(), make(map[DistribKey]<-chan bool), NewRunner(), CHAN_SLACK, 0, 0, nil, nil, nil, nil}
+}
+
+// SetBuffer sets the capacity of the input channels of the branches created from now on
+func (op *DistributeOperator) SetBuffer(n int) *DistributeOperator {
+	op.buffer = n
+	return op
 }
 
-func (op *DistributeOperator) createBranch(key DistribKey) {
+// SetIdleTimeout closes the input of branches that got no object for d, letting them flush and exit.
+// A later object with the same key creates a new branch, once the evicted one exited so that the objects
+// of a key stay in order. 0 (the default) keeps branches until shutdown.
+func (op *DistributeOperator) SetIdleTimeout(d time.Duration) *DistributeOperator {
+	op.idleTimeout = d
+	return op
+}
+
+// SetMaxBranches caps the number of open branches, evicting the least recently used one when a new key
+// needs a branch. Like on an idle timeout, the evicted branch flushes and exits before its key gets a new
+// one. 0 (the default) means no limit.
+func (op *DistributeOperator) SetMaxBranches(n int) *DistributeOperator {
+	op.maxBranches = n
+	return op
+}
+
+// SetHooks sets functions called from the distributor goroutine after a branch is created and after it
+// is evicted. Either may be nil.
+func (op *DistributeOperator) SetHooks(onCreate func(DistribKey, DistributorChildOp), onEvict func(DistribKey, DistributorChildOp, BranchEviction)) *DistributeOperator {
+	op.onCreate = onCreate
+	op.onEvict = onEvict
+	return op
+}
+
+func (op *DistributeOperator) SetMetrics(m *util.MetricsGroup) {
+	op.metrics = m
+}
+
+// Branches returns the open branches, evicted branches still flushing are not included
+func (op *DistributeOperator) Branches() []Operator {
+	return op.runner.Operators()
+}
+
+func (op *DistributeOperator) createBranch(key DistribKey) (*distribBranch, error) {
+	if op.maxBranches > 0 && op.lru.Len() >= op.maxBranches {
+		op.evict(op.lru.Back(), EVICT_LRU)
+	}
+
 	newop := op.branchCreator(key)
-	ch := make(chan Object, CHAN_SLACK)
+	if err := validateBranch(fmt.Sprintf("%s/%v", Name(op), key), newop, false); err != nil {
+		return nil, err
+	}
+	if (op.maxBranches > 0 || op.idleTimeout > 0) && !retirable(newop) {
+		return nil, fmt.Errorf("Distribute branch %v cannot be evicted, %s is not comparable", key, Name(newop))
+	}
+	ch := make(chan Object, op.buffer)
 	newop.SetIn(ch)
 	op.runner.Add(newop)
 	op.runner.AsyncRun(newop)
-	op.outputs[key] = ch
+
+	b := &distribBranch{key, newop, ch, time.Now()}
+	op.outputs[key] = op.lru.PushFront(b)
+	if op.onCreate != nil {
+		op.onCreate(key, newop)
+	}
+	return b, nil
+}
+
+// evict closes the input of a branch, which flushes and exits. The branch is dropped from the index even
+// if the runner can't retire it, so that the branch cap holds; createBranch keeps this from happening.
+func (op *DistributeOperator) evict(e *list.Element, reason BranchEviction) {
+	b := e.Value.(*distribBranch)
+	op.lru.Remove(e)
+	delete(op.outputs, b.key)
+	op.forgetExited()
+	if exited := op.runner.Retire(b.op); exited != nil {
+		op.evicted[b.key] = exited
+	} else {
+		slog.Logf(logger.Levels.Error, "Cannot retire distribute branch %v, %s is not comparable", b.key, Name(b.op))
+	}
+	slog.Logf(logger.Levels.Info, "Evicting distribute branch %v", b.key)
+	close(b.ch)
+	if op.onEvict != nil {
+		op.onEvict(b.key, b.op, reason)
+	}
+}
+
+// forgetExited drops the evicted branches that exited
+func (op *DistributeOperator) forgetExited() {
+	for key, exited := range op.evicted {
+		select {
+		case <-exited:
+			delete(op.evicted, key)
+		default:
+		}
+	}
+}
+
+// waitEvicted waits for the evicted branch of key, if any, to flush and exit. Otherwise the new branch
+// of the key could output objects before the older ones. It returns false if the distributor is stopped
+// meanwhile.
+func (op *DistributeOperator) waitEvicted(ctx context.Context, key DistribKey) bool {
+	exited, ok := op.evicted[key]
+	if !ok {
+		return true
+	}
+	delete(op.evicted, key)
+	select {
+	case <-exited:
+		return true
+	case <-op.StopNotifier:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (op *DistributeOperator) evictIdle(now time.Time) {
+	for e := op.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if now.Sub(e.Value.(*distribBranch).lastUsed) < op.idleTimeout {
+			return
+		}
+		op.evict(e, EVICT_IDLE)
+		e = prev
+	}
 }
 
 func (op *DistributeOperator) Run() error {
-	defer op.runner.WaitGroup().Wait()
+	return op.RunContext(context.Background())
+}
+
+func (op *DistributeOperator) RunContext(ctx context.Context) error {
+	defer op.runner.Wait()
+	op.runner.SetContext(ctx)
 	defer func() {
-		for _, out := range op.outputs {
-			close(out)
+		for _, e := range op.outputs {
+			close(e.Value.(*distribBranch).ch)
 		}
 	}()
 
+	var idle <-chan time.Time
+	if op.idleTimeout > 0 {
+		ticker := time.NewTicker(op.idleTimeout / 2)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	if op.strategy != nil {
+		for b := 0; b < op.strategy.NumBranches(); b++ {
+			if _, err := op.createBranch(b); err != nil {
+				slog.Logf(logger.Levels.Error, "Cannot create distribute branch: %v", err)
+				op.runner.HardStop()
+				return err
+			}
+		}
+	}
+
 	for {
 		select {
 		case obj, ok := <-op.In():
 			if ok {
+				start := time.Now()
 				key := op.mapper(obj)
-				ch, ok := op.outputs[key]
-				if !ok {
-					op.createBranch(key)
-					ch, ok = op.outputs[key]
-					if !ok {
-						slog.Fatalf("couldn't find channel right after key create")
+				var b *distribBranch
+				if e, ok := op.outputs[key]; ok {
+					b = e.Value.(*distribBranch)
+					b.lastUsed = start
+					op.lru.MoveToFront(e)
+				} else {
+					if !op.waitEvicted(ctx, key) {
+						op.runner.HardStop()
+						return nil
+					}
+					var err error
+					if b, err = op.createBranch(key); err != nil {
+						slog.Logf(logger.Levels.Error, "Cannot create distribute branch: %v", err)
+						op.runner.HardStop()
+						return err
 					}
-
 				}
-				ch <- obj
+				b.ch <- obj
+				recordItem(op.metrics, start)
+				recordOut(op.metrics, 1)
 			} else {
 				return nil
 			}
+		case now := <-idle:
+			op.evictIdle(now)
 		case <-op.StopNotifier:
 			op.runner.HardStop()
 			return nil
+		case <-ctx.Done():
+			op.runner.HardStop()
+			return nil
 		case <-op.runner.CloseNotifier():
 			slog.Logf(logger.Levels.Error, "Unexpected child close in distribute op")
 			op.runner.HardStop()
-			return errors.New("Unexpected distribute child close")
+			op.runner.WaitGroup().Wait()
+			return errors.Join(errors.New("Unexpected distribute child close"), op.runner.Err())
 		}
 	}
 }
+
+func (op *DistributeOperator) Pending() int {
+	return op.GetInDepth() + pendingOfAll(op.runner.Operators())
+}
@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrDrainTimeout = errors.New("Drain timed out, chain was hard stopped")
+
+// PendingCounter is implemented by operators that hold objects outside of their input channel
+// (unflushed batches, unacknowledged sends, child operators...).
+// Pending returns the number of objects held, including the ones waiting in the input channel.
+type PendingCounter interface {
+	Pending() int
+}
+
+// Dropped is the number of objects an operator still held when a drain was cut short
+type Dropped struct {
+	Op    string
+	Count int
+}
+
+func pendingOf(op Operator) int {
+	if pc, ok := op.(PendingCounter); ok {
+		return pc.Pending()
+	}
+	if in, ok := op.(In); ok && in.In() != nil {
+		return in.GetInDepth()
+	}
+	return 0
+}
+
+func pendingOfAll(ops []Operator) int {
+	total := 0
+	for _, op := range ops {
+		total += pendingOf(op)
+	}
+	return total
+}
+
+// Drain stops reading new input and waits for the operators to flush everything in flight and exit.
+// If that takes longer than timeout, the chain is hard stopped and Drain returns ErrDrainTimeout along with
+// the number of objects each operator still held, in chain order.
+func (c *SimpleChain) Drain(timeout time.Duration) ([]Dropped, error) {
+	c.SoftStop()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		c.runner.Wait()
+	}()
+
+	select {
+	case <-done:
+		return nil, c.runner.Err()
+	case <-time.After(timeout):
+	}
+
+	dropped := make([]Dropped, 0)
+	for _, op := range c.runner.Operators() {
+		if n := pendingOf(op); n > 0 {
+			dropped = append(dropped, Dropped{Name(op), n})
+		}
+	}
+	c.runner.HardStop()
+	<-done
+	return dropped, errors.Join(ErrDrainTimeout, c.runner.Err())
+}
@@ -55,27 +55,16 @@ func NewGobEncodeRop() stream.InOutOperator {
 
 	generator := func() interface{} {
 		var buf bytes.Buffer
-		fn := func(in interface{}) [][]byte {
+		fn := func(in stream.Object, out mapper.Outputer) error {
 			enc := gob.NewEncoder(&buf) //each output is an indy stream
-			err := enc.Encode(in)
-			if err != nil {
-				log.Printf("Error marshaling gob: %v\n", err.Error())
+			if err := enc.Encode(in); err != nil {
+				buf.Reset()
+				return err
 			}
-			n := buf.Len()
-			out := make([]byte, n)
-			if out == nil {
-				log.Printf("Make failed")
-			}
-			newn, err := buf.Read(out)
-			if newn != n || err != nil {
-				if err == nil {
-					log.Printf("Error marshaling gob on read: %v\t%v\n", newn, n)
-				} else {
-					log.Printf("Error marshaling gob on read: %v\t%v\t%v\n", newn, n, err.Error())
-				}
-			}
-
-			return [][]byte{out}
+			res := make([]byte, buf.Len())
+			buf.Read(res)
+			out.Out(1) <- res
+			return nil
 		}
 		return fn
 	}
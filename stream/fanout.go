@@ -1,9 +1,12 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util"
 	"github.com/cloudflare/go-stream/util/slog"
+	"time"
 )
 
 type fanoutChildOp interface {
@@ -14,29 +17,82 @@ type fanoutChildOp interface {
 type FanoutOperator struct {
 	*HardStopChannelCloser
 	*BaseIn
-	outputs []chan Object
+	outputs []*fanoutBranch
 	runner  *Runner
+	buffer  int
+	metrics *util.MetricsGroup
 	//ops     []fanoutChildOp // this can be a single operator or a chain
 }
 
 func NewFanoutOp() *FanoutOperator {
-	return &FanoutOperator{NewHardStopChannelCloser(), NewBaseIn(CHAN_SLACK), make([]chan Object, 0, 2), NewRunner()}
+	return &FanoutOperator{NewHardStopChannelCloser(), NewBaseIn(CHAN_SLACK), make([]*fanoutBranch, 0, 2), NewRunner(), CHAN_SLACK, nil}
+}
+
+// SetBuffer sets the capacity of the input channels of the branches added by subsequent calls to Add
+func (op *FanoutOperator) SetBuffer(n int) *FanoutOperator {
+	if n < 0 {
+		slog.Logf(logger.Levels.Error, "Negative buffer %d for fanout, using %d", n, CHAN_SLACK)
+		n = CHAN_SLACK
+	}
+	op.buffer = n
+	return op
 }
 
 func (op *FanoutOperator) Add(newOp fanoutChildOp) {
-	ch := make(chan Object, CHAN_SLACK)
+	op.AddWithBuffer(newOp, op.buffer)
+}
+
+// AddWithBuffer adds a branch whose input channel has capacity n
+func (op *FanoutOperator) AddWithBuffer(newOp fanoutChildOp, n int) {
+	op.AddBranch(newOp, n, nil)
+}
+
+// AddWithPolicy adds a branch handled according to policy when its input channel is full
+func (op *FanoutOperator) AddWithPolicy(newOp fanoutChildOp, policy *BranchPolicy) {
+	op.AddBranch(newOp, op.buffer, policy)
+}
+
+// AddBranch adds a branch whose input channel has capacity n. A nil policy blocks on a full channel.
+func (op *FanoutOperator) AddBranch(newOp fanoutChildOp, n int, policy *BranchPolicy) {
+	if n < 0 {
+		slog.Logf(logger.Levels.Error, "Negative buffer %d for %s, using %d", n, Name(newOp), op.buffer)
+		n = op.buffer
+	}
+	ch := make(chan Object, n)
 	newOp.SetIn(ch)
-	op.outputs = append(op.outputs, ch)
+	op.outputs = append(op.outputs, newFanoutBranch(Name(newOp), ch, policy))
 	op.runner.Add(newOp)
 }
 
+// Dropped returns the number of objects each branch has dropped so far, in the order they were added
+func (op *FanoutOperator) Dropped() []Dropped {
+	dropped := make([]Dropped, len(op.outputs))
+	for i, out := range op.outputs {
+		dropped[i] = Dropped{out.name, out.Dropped()}
+	}
+	return dropped
+}
+
+func (op *FanoutOperator) SetMetrics(m *util.MetricsGroup) {
+	op.metrics = m
+}
+
+func (op *FanoutOperator) Branches() []Operator {
+	return op.runner.Operators()
+}
+
 func (op *FanoutOperator) Run() error {
-	defer op.runner.WaitGroup().Wait()
-	op.runner.AsyncRunAll()
+	return op.RunContext(context.Background())
+}
 
+func (op *FanoutOperator) RunContext(ctx context.Context) error {
+	defer op.runner.Wait()
+	op.runner.AsyncRunAllContext(ctx)
+
+	abort := make(chan bool)
 	defer func() {
 		for _, out := range op.outputs {
-			close(out)
+			out.close()
 		}
 	}()
 
@@ -44,19 +100,40 @@ func (op *FanoutOperator) Run() error {
 		select {
 		case obj, ok := <-op.In():
 			if ok {
+				start := time.Now()
+				sent := 0
 				for _, out := range op.outputs {
-					out <- obj
+					if out.send(obj, abort) {
+						sent++
+					}
 				}
+				recordItem(op.metrics, start)
+				recordOut(op.metrics, sent)
 			} else {
 				return nil
 			}
 		case <-op.StopNotifier:
+			close(abort)
+			op.runner.HardStop()
+			return nil
+		case <-ctx.Done():
+			close(abort)
 			op.runner.HardStop()
 			return nil
 		case <-op.runner.CloseNotifier():
 			slog.Logf(logger.Levels.Error, "Unexpected child close in fanout op")
+			close(abort)
 			op.runner.HardStop()
-			return errors.New("Unexpected child close")
+			op.runner.WaitGroup().Wait()
+			return errors.Join(errors.New("Unexpected child close"), op.runner.Err())
 		}
 	}
 }
+
+func (op *FanoutOperator) Pending() int {
+	spilled := 0
+	for _, out := range op.outputs {
+		spilled += out.pending()
+	}
+	return op.GetInDepth() + spilled + pendingOfAll(op.runner.Operators())
+}
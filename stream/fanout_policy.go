@@ -0,0 +1,186 @@
+package stream
+
+import (
+	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// FanoutPolicy decides what a fanout does when a branch's input channel is full
+type FanoutPolicy int
+
+const (
+	FANOUT_BLOCK       FanoutPolicy = iota //wait for the branch, stalling every other branch (default)
+	FANOUT_DROP_NEWEST                     //drop the object being sent
+	FANOUT_DROP_OLDEST                     //drop the oldest object waiting in the branch's channel
+	FANOUT_SPILL                           //queue objects in a file until the branch catches up
+	FANOUT_DETACH                          //block up to Timeout, then stop sending to the branch for good
+)
+
+type BranchPolicy struct {
+	Policy FanoutPolicy
+
+	Timeout time.Duration //FANOUT_DETACH
+
+	//FANOUT_SPILL: the spill file is created in SpillDir (os.TempDir() if empty). Without Encode/Decode
+	//objects must be []byte.
+	SpillDir string
+	Encode   func(Object) ([]byte, error)
+	Decode   func([]byte) (Object, error)
+}
+
+type fanoutBranch struct {
+	name     string
+	ch       chan Object
+	policy   BranchPolicy
+	dropped  int64 //atomic
+	detached bool
+	spill    atomic.Pointer[spillQueue] //set by the fanout goroutine, read by pending
+	feeding  chan bool //closed when the spill feeder exits
+}
+
+func newFanoutBranch(name string, ch chan Object, policy *BranchPolicy) *fanoutBranch {
+	b := &fanoutBranch{name: name, ch: ch}
+	if policy != nil {
+		b.policy = *policy
+	}
+	return b
+}
+
+func (b *fanoutBranch) drop() {
+	atomic.AddInt64(&b.dropped, 1)
+}
+
+func (b *fanoutBranch) Dropped() int {
+	return int(atomic.LoadInt64(&b.dropped))
+}
+
+// send delivers obj according to the policy, returns false if obj was dropped
+func (b *fanoutBranch) send(obj Object, abort chan bool) bool {
+	switch b.policy.Policy {
+	case FANOUT_DROP_NEWEST:
+		select {
+		case b.ch <- obj:
+			return true
+		default:
+			b.drop()
+			return false
+		}
+	case FANOUT_DROP_OLDEST:
+		for {
+			select {
+			case b.ch <- obj:
+				return true
+			default:
+			}
+			select {
+			case <-b.ch:
+				b.drop()
+			default:
+			}
+		}
+	case FANOUT_SPILL:
+		if q := b.spill.Load(); q == nil || q.Len() == 0 {
+			select {
+			case b.ch <- obj:
+				return true
+			default:
+			}
+		}
+		return b.spillObj(obj, abort)
+	case FANOUT_DETACH:
+		if b.detached {
+			b.drop()
+			return false
+		}
+		select {
+		case b.ch <- obj:
+			return true
+		default:
+		}
+		timer := time.NewTimer(b.policy.Timeout)
+		defer timer.Stop()
+		select {
+		case b.ch <- obj:
+			return true
+		case <-timer.C:
+			slog.Logf(logger.Levels.Warn, "Detaching fanout branch %s, blocked for more than %v", b.name, b.policy.Timeout)
+			b.detached = true
+			b.drop()
+			return false
+		}
+	}
+	b.ch <- obj
+	return true
+}
+
+func (b *fanoutBranch) spillObj(obj Object, abort chan bool) bool {
+	q := b.spill.Load()
+	if q == nil {
+		dir := b.policy.SpillDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		var err error
+		q, err = newSpillQueue(dir, b.policy.Encode, b.policy.Decode)
+		if err != nil {
+			slog.Logf(logger.Levels.Error, "Cannot create spill file for fanout branch %s: %v", b.name, err)
+			b.drop()
+			return false
+		}
+		b.feeding = make(chan bool)
+		b.spill.Store(q)
+		go b.feed(q, abort)
+	}
+	if err := q.Push(obj); err != nil {
+		slog.Logf(logger.Levels.Error, "Cannot spill object for fanout branch %s: %v", b.name, err)
+		b.drop()
+		return false
+	}
+	return true
+}
+
+// feed moves spilled objects to the branch in order, until the spill queue is closed and empty or abort is closed
+func (b *fanoutBranch) feed(q *spillQueue, abort chan bool) {
+	defer close(b.feeding)
+	for {
+		obj, ok, err := q.Pop()
+		if !ok {
+			if err != nil {
+				slog.Logf(logger.Levels.Error, "Cannot read spill file of fanout branch %s: %v", b.name, err)
+			}
+			return
+		}
+		if err != nil {
+			slog.Logf(logger.Levels.Error, "Cannot decode spilled object of fanout branch %s: %v", b.name, err)
+			b.drop()
+			q.Delivered()
+			continue
+		}
+		select {
+		case b.ch <- obj:
+			q.Delivered()
+		case <-abort:
+			return
+		}
+	}
+}
+
+func (b *fanoutBranch) pending() int {
+	if q := b.spill.Load(); q != nil {
+		return q.Len()
+	}
+	return 0
+}
+
+// close closes the branch's channel once the spilled objects are delivered (unless aborted)
+func (b *fanoutBranch) close() {
+	if q := b.spill.Load(); q != nil {
+		q.Close()
+		<-b.feeding
+		q.Remove()
+	}
+	close(b.ch)
+}
@@ -0,0 +1,210 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util"
+	"github.com/cloudflare/go-stream/util/slog"
+	"time"
+)
+
+type JoinType int
+
+const (
+	INNER_JOIN      JoinType = iota
+	LEFT_OUTER_JOIN          //left objects without a match are combined with a nil right
+)
+
+// JoinSide extracts the join key and the event time of the objects of one input
+type JoinSide struct {
+	Key  func(Object) interface{}
+	Time func(Object) time.Time
+}
+
+type joinEntry struct {
+	obj     Object
+	key     interface{}
+	t       time.Time
+	matched bool
+}
+
+// joinBuffer holds the objects of one side, by key and in arrival order
+type joinBuffer struct {
+	byKey map[interface{}][]*joinEntry
+	queue []*joinEntry
+}
+
+func newJoinBuffer() *joinBuffer {
+	return &joinBuffer{make(map[interface{}][]*joinEntry), make([]*joinEntry, 0)}
+}
+
+func (b *joinBuffer) add(e *joinEntry) {
+	b.byKey[e.key] = append(b.byKey[e.key], e)
+	b.queue = append(b.queue, e)
+}
+
+// evict removes the entries at the head of the queue older than cutoff
+func (b *joinBuffer) evict(cutoff time.Time, evicted func(*joinEntry)) {
+	n := 0
+	for ; n < len(b.queue) && b.queue[n].t.Before(cutoff); n++ {
+		e := b.queue[n]
+		entries := b.byKey[e.key]
+		for i, other := range entries {
+			if other == e {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+		if len(entries) == 0 {
+			delete(b.byKey, e.key)
+		} else {
+			b.byKey[e.key] = entries
+		}
+		evicted(e)
+	}
+	b.queue = b.queue[n:]
+}
+
+func (b *joinBuffer) drain(evicted func(*joinEntry)) {
+	for _, e := range b.queue {
+		evicted(e)
+	}
+	b.queue = b.queue[:0]
+	b.byKey = make(map[interface{}][]*joinEntry)
+}
+
+// JoinOperator is a windowed hash join: each object of the left input (In) is combined with the objects of
+// the right input with the same key whose event time is within window of its own. Objects are buffered
+// until the watermark, the latest event time seen on either input, is window past them, so both inputs
+// should progress roughly together. The output closes when the left input closes.
+type JoinOperator struct {
+	*HardStopChannelCloser
+	*BaseIn
+	*BaseOut
+	right     chan Object
+	leftSide  JoinSide
+	rightSide JoinSide
+	window    time.Duration
+	typ       JoinType
+	combine   func(left Object, right Object) Object
+	runner    *Runner
+	metrics   *util.MetricsGroup
+}
+
+func NewJoinOp(left JoinSide, right JoinSide, window time.Duration, typ JoinType, combine func(left Object, right Object) Object) *JoinOperator {
+	return &JoinOperator{NewHardStopChannelCloser(), NewBaseIn(CHAN_SLACK), NewBaseOut(CHAN_SLACK), make(chan Object, CHAN_SLACK),
+		left, right, window, typ, combine, NewRunner(), nil}
+}
+
+func (op *JoinOperator) Right() chan Object {
+	return op.right
+}
+
+func (op *JoinOperator) SetRight(ch chan Object) {
+	op.right = ch
+}
+
+// AddRight makes the output of upstream, an operator or a chain wrapped with NewOutChainWrapper, the right
+// input. upstream is run by the join.
+func (op *JoinOperator) AddRight(upstream mergeChildOp) {
+	upstream.SetOut(op.right)
+	op.runner.Add(upstream)
+}
+
+func (op *JoinOperator) RightInputs() []Operator {
+	return op.runner.Operators()
+}
+
+func (op *JoinOperator) SetMetrics(m *util.MetricsGroup) {
+	op.metrics = m
+}
+
+func (op *JoinOperator) Pending() int {
+	return op.GetInDepth() + len(op.right) + pendingOfAll(op.runner.Operators())
+}
+
+func (op *JoinOperator) Run() error {
+	return op.RunContext(context.Background())
+}
+
+func (op *JoinOperator) RunContext(ctx context.Context) error {
+	defer op.runner.Wait()
+	op.runner.AsyncRunAllContext(ctx)
+	defer op.runner.HardStop()
+	defer close(op.Out())
+
+	lefts, rights := newJoinBuffer(), newJoinBuffer()
+	var watermark time.Time
+	right := op.right
+
+	emitUnmatched := func(e *joinEntry) {
+		if op.typ == LEFT_OUTER_JOIN && !e.matched {
+			op.Out() <- op.combine(e.obj, nil)
+			recordOut(op.metrics, 1)
+		}
+	}
+	noop := func(*joinEntry) {}
+
+	advance := func(t time.Time) {
+		if t.After(watermark) {
+			watermark = t
+			cutoff := watermark.Add(-op.window)
+			lefts.evict(cutoff, emitUnmatched)
+			rights.evict(cutoff, noop)
+		}
+	}
+
+	for {
+		select {
+		case obj, ok := <-op.In():
+			if !ok {
+				lefts.drain(emitUnmatched)
+				return nil
+			}
+			start := time.Now()
+			e := &joinEntry{obj, op.leftSide.Key(obj), op.leftSide.Time(obj), false}
+			for _, r := range rights.byKey[e.key] {
+				if op.within(e.t, r.t) {
+					op.Out() <- op.combine(e.obj, r.obj)
+					recordOut(op.metrics, 1)
+					e.matched = true
+				}
+			}
+			lefts.add(e)
+			advance(e.t)
+			recordItem(op.metrics, start)
+		case obj, ok := <-right:
+			if !ok {
+				right = nil
+				continue
+			}
+			start := time.Now()
+			e := &joinEntry{obj, op.rightSide.Key(obj), op.rightSide.Time(obj), false}
+			for _, l := range lefts.byKey[e.key] {
+				if op.within(l.t, e.t) {
+					op.Out() <- op.combine(l.obj, e.obj)
+					recordOut(op.metrics, 1)
+					l.matched = true
+				}
+			}
+			rights.add(e)
+			advance(e.t)
+			recordItem(op.metrics, start)
+		case <-op.runner.ErrorChannel():
+			slog.Logf(logger.Levels.Error, "Right input failed in join op")
+			op.runner.HardStop()
+			op.runner.WaitGroup().Wait()
+			return errors.Join(errors.New("Join right input failed"), op.runner.Err())
+		case <-op.StopNotifier:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (op *JoinOperator) within(left time.Time, right time.Time) bool {
+	d := left.Sub(right)
+	return d <= op.window && d >= -op.window
+}
@@ -0,0 +1,224 @@
+package mapper
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/util/slog"
+	"sync"
+	"time"
+)
+
+type ErrorAction int
+
+const (
+	ERROR_SKIP        ErrorAction = iota //the item is dropped
+	ERROR_FAIL                           //the op stops and returns the error, failing the chain
+	ERROR_DEAD_LETTER                    //a *DeadLetter with the item and the error is sent to the dead letter chain
+)
+
+// ErrorPolicy tells what to do with the items whose callback returned an error. Failed items are retried up
+// to Retries times, waiting Backoff before the first retry and doubling it each time, then handled per Action.
+// The outputs of an item are held back until its callback succeeds, so a failed attempt sends nothing.
+type ErrorPolicy struct {
+	Action  ErrorAction
+	Retries int
+	Backoff time.Duration
+}
+
+// DeadLetter is an item that failed and the last error it failed with
+type DeadLetter struct {
+	Item stream.Object
+	Err  error
+}
+
+// ErrorWorker is implemented by the workers of callbacks returning an error
+type ErrorWorker interface {
+	MapErr(input stream.Object, out Outputer) error
+}
+
+type errorHandling struct {
+	policy     ErrorPolicy
+	deadLetter stream.InChain
+	ch         chan stream.Object
+	runner     *stream.Runner
+	cancel     context.CancelFunc //stops the workers when the op fails
+	failed     chan bool
+	lock       sync.Mutex
+	err        error
+}
+
+// NewOpErr creates an op from a callback that may fail on an item. Without an error policy failed items are
+// logged and skipped.
+func NewOpErr(callback func(obj stream.Object, out Outputer) error, tn string) *Op {
+	return NewOp(callback, tn)
+}
+
+func (o *Op) handling() *errorHandling {
+	if o.onError == nil {
+		o.onError = &errorHandling{}
+	}
+	return o.onError
+}
+
+func (o *Op) SetErrorPolicy(p ErrorPolicy) *Op {
+	o.handling().policy = p
+	return o
+}
+
+// SetDeadLetter sets the chain receiving the dead letters of the ERROR_DEAD_LETTER action. The op runs it
+// and closes its input when exiting.
+func (o *Op) SetDeadLetter(c stream.InChain) *Op {
+	h := o.handling()
+	h.deadLetter = c
+	h.ch = make(chan stream.Object, stream.CHAN_SLACK)
+	c.SetIn(h.ch)
+	return o
+}
+
+func (o *Op) DeadLetter() stream.InChain {
+	if o.onError == nil {
+		return nil
+	}
+	return o.onError.deadLetter
+}
+
+// startErrors runs the dead letter chain and returns the context of the workers, done when the op fails
+func (o *Op) startErrors(ctx context.Context) context.Context {
+	o.handling().failed = make(chan bool)
+	if o.onError.deadLetter != nil {
+		o.onError.runner = stream.NewRunner()
+		o.onError.runner.Add(o.onError.deadLetter)
+		o.onError.runner.AsyncRunAllContext(ctx)
+	}
+	ctx, o.onError.cancel = context.WithCancel(ctx)
+	return ctx
+}
+
+// exitErr waits for the dead letter chain and returns the error failing the op, if any
+func (o *Op) exitErr() error {
+	o.onError.cancel()
+	var err error
+	if o.onError.runner != nil {
+		close(o.onError.ch)
+		o.onError.runner.Wait()
+		err = o.onError.runner.Err()
+	}
+	o.onError.lock.Lock()
+	defer o.onError.lock.Unlock()
+	return errors.Join(o.onError.err, err)
+}
+
+// mapItem maps obj with worker, retrying and handling the errors as the policy says.
+// A panic fails the op whatever the policy. The errors failing the op are counted by the Runner, which
+// counts the error returned by Run; skipped and dead letter items are counted here.
+func (o *Op) mapItem(ctx context.Context, worker Worker, obj stream.Object, out Outputer) {
+	defer func() {
+		if r := recover(); r != nil {
+			o.fail(stream.NewPanicError(o.Typename, r))
+		}
+	}()
+	ew, ok := worker.(ErrorWorker)
+	if !ok {
+		worker.Map(obj, out)
+		return
+	}
+	policy := o.onError.policy
+
+	err := o.attempt(ew, obj, out)
+	backoff := policy.Backoff
+	for retry := 0; err != nil && retry < policy.Retries; retry++ {
+		if o.metrics != nil {
+			o.metrics.Retries.Inc(1)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-o.StopNotifier:
+			return
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		err = o.attempt(ew, obj, out)
+	}
+	if err == nil {
+		return
+	}
+
+	if policy.Action == ERROR_FAIL {
+		o.fail(err)
+		return
+	}
+	if o.metrics != nil {
+		o.metrics.Errors.Inc(1)
+	}
+	switch policy.Action {
+	case ERROR_SKIP:
+		slog.Logf(logger.Levels.Warn, "%s skipping item: %v", o.Typename, err)
+	case ERROR_DEAD_LETTER:
+		if o.onError.deadLetter == nil {
+			slog.Logf(logger.Levels.Error, "%s has no dead letter chain, skipping item: %v", o.Typename, err)
+			return
+		}
+		select {
+		case o.onError.ch <- &DeadLetter{obj, err}:
+			if o.metrics != nil {
+				o.metrics.DeadLetters.Inc(1)
+			}
+		case <-o.StopNotifier:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// attempt maps obj once, holding its outputs back until it succeeds
+func (o *Op) attempt(ew ErrorWorker, obj stream.Object, out Outputer) error {
+	h := &heldOutputer{}
+	if err := ew.MapErr(obj, h); err != nil {
+		return err
+	}
+	h.flush(out)
+	return nil
+}
+
+// fail records the first error and stops the workers
+func (o *Op) fail(err error) {
+	o.onError.lock.Lock()
+	defer o.onError.lock.Unlock()
+	if o.onError.err != nil {
+		return
+	}
+	slog.Logf(logger.Levels.Error, "%s failed: %v", o.Typename, err)
+	o.onError.err = err
+	o.onError.cancel()
+	close(o.onError.failed)
+}
+
+// heldOutputer keeps the outputs of an attempt, Out(n) returns a channel with room for n objects
+type heldOutputer struct {
+	chs []chan stream.Object
+}
+
+func (h *heldOutputer) Out(num int) chan<- stream.Object {
+	ch := make(chan stream.Object, num)
+	h.chs = append(h.chs, ch)
+	return ch
+}
+
+func (h *heldOutputer) flush(out Outputer) {
+	n := 0
+	for _, ch := range h.chs {
+		n += len(ch)
+	}
+	if n == 0 {
+		return
+	}
+	outCh := out.Out(n)
+	for _, ch := range h.chs {
+		close(ch)
+		for obj := range ch {
+			outCh <- obj
+		}
+	}
+}
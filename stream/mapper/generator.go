@@ -21,6 +21,10 @@ func (w *CallbackGenerator) GetWorker() Worker {
 	if ok {
 		return &EfficientWorker{callback: direct, typename: w.typename}
 	}
+	withErr, ok := w.callback.(func(obj stream.Object, out Outputer) error)
+	if ok {
+		return &EfficientErrorWorker{EfficientWorker{typename: w.typename}, withErr}
+	}
 	return &CallbackWorker{callback: reflect.ValueOf(w.callback), typename: w.typename}
 }
 
@@ -43,6 +47,10 @@ func (w *WorkerFactoryGenerator) GetWorker() Worker {
 	if ok {
 		return &EfficientWorker{callback: direct}
 	}
+	withErr, ok := ret[0].Elem().Interface().(func(obj stream.Object, out Outputer) error)
+	if ok {
+		return &EfficientErrorWorker{errCallback: withErr}
+	}
 	return &CallbackWorker{callback: ret[0].Elem()}
 }
 
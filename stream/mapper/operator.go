@@ -1,13 +1,14 @@
 package mapper
 
-import "runtime"
-import "sync"
+import "context"
+import "time"
 import "github.com/cloudflare/go-stream/stream"
+import "github.com/cloudflare/go-stream/util"
 
 func NewOp(proc interface{}, tn string) *Op {
 	gen := CallbackGenerator{callback: proc, typename: tn}
 	base := stream.NewBaseInOutOp(stream.CHAN_SLACK)
-	op := Op{base, &gen, tn, true}
+	op := Op{base, &gen, tn, true, nil, workerPool{}, nil}
 	op.Init()
 	return &op
 }
@@ -15,7 +16,7 @@ func NewOp(proc interface{}, tn string) *Op {
 func NewOpExitor(callback interface{}, exitCallback func(), tn string) *Op {
 	gen := CallbackGenerator{callback: callback, exitCallback: exitCallback, typename: tn}
 	base := stream.NewBaseInOutOp(stream.CHAN_SLACK)
-	op := Op{base, &gen, tn, true}
+	op := Op{base, &gen, tn, true, nil, workerPool{}, nil}
 	op.Init()
 	return &op
 }
@@ -23,7 +24,7 @@ func NewOpExitor(callback interface{}, exitCallback func(), tn string) *Op {
 func NewOpFactory(proc interface{}, tn string) *Op {
 	gen := WorkerFactoryGenerator{proc}
 	base := stream.NewBaseInOutOp(stream.CHAN_SLACK)
-	op := Op{base, &gen, tn, true}
+	op := Op{base, &gen, tn, true, nil, workerPool{}, nil}
 	op.Init()
 	return &op
 }
@@ -31,7 +32,7 @@ func NewOpFactory(proc interface{}, tn string) *Op {
 func NewOpWorkerCloserFactory(proc interface{}, tn string) *Op {
 	gen := WorkerCloserFactoryGenerator{proc}
 	base := stream.NewBaseInOutOp(stream.CHAN_SLACK)
-	op := Op{base, &gen, tn, true}
+	op := Op{base, &gen, tn, true, nil, workerPool{}, nil}
 	op.Init()
 	return &op
 }
@@ -39,7 +40,7 @@ func NewOpWorkerCloserFactory(proc interface{}, tn string) *Op {
 func NewOpWorkerFinalItemsFactory(proc interface{}, tn string) *Op {
 	gen := WorkerFinalItemsFactoryGenerator{proc}
 	base := stream.NewBaseInOutOp(stream.CHAN_SLACK)
-	op := Op{base, &gen, tn, true}
+	op := Op{base, &gen, tn, true, nil, workerPool{}, nil}
 	op.Init()
 	return &op
 }
@@ -61,6 +62,9 @@ type Op struct {
 	Gen      Generator
 	Typename string
 	Parallel bool
+	metrics  *util.MetricsGroup
+	pool     workerPool
+	onError  *errorHandling
 }
 
 func (o *Op) Init() bool {
@@ -89,6 +93,24 @@ func (o *Op) String() string {
 	return o.Typename
 }
 
+func (o *Op) SetMetrics(m *util.MetricsGroup) {
+	o.metrics = m
+}
+
+func (o *Op) instrumentOutputer(out Outputer) Outputer {
+	if o.metrics == nil {
+		return out
+	}
+	return &countingOutputer{out, o.metrics}
+}
+
+func (o *Op) recordItem(start time.Time) {
+	if o.metrics != nil {
+		o.metrics.In.Inc(1)
+		o.metrics.Latency.Update(int64(time.Since(start)))
+	}
+}
+
 func (o *Op) WorkerStop(worker Worker) {
 	stopper, ok := worker.(Stopper)
 	if ok {
@@ -111,20 +133,26 @@ func (o *Op) WorkerClose(worker Worker, outputer Outputer) {
 	}
 }
 
-func (o *Op) runWorker(worker Worker, outCh chan stream.Object) {
-	outputer := NewSimpleOutputer(outCh)
+func (o *Op) runWorker(ctx context.Context, worker Worker, outCh chan stream.Object, retire <-chan bool) bool {
+	outputer := o.instrumentOutputer(NewSimpleOutputer(outCh))
 	for {
 		select {
 		case obj, ok := <-o.In():
 			if ok {
-				worker.Map(obj, outputer)
+				o.process(ctx, worker, obj, outputer)
 			} else {
 				o.WorkerClose(worker, outputer)
-				return
+				return false
 			}
+		case <-retire:
+			o.WorkerClose(worker, outputer)
+			return true
 		case <-o.StopNotifier:
 			o.WorkerStop(worker)
-			return
+			return false
+		case <-ctx.Done():
+			o.WorkerStop(worker)
+			return false
 		}
 	}
 }
@@ -137,27 +165,19 @@ func (o *Op) Exit() {
 }
 
 func (o *Op) Run() error {
+	return o.RunContext(context.Background())
+}
+
+// RunContext runs the op; its workers hard stop when ctx is done.
+func (o *Op) RunContext(ctx context.Context) error {
 	defer close(o.Out())
 	//perform some validation
 	//Processor.Validate()
 
-	maxWorkers := runtime.NumCPU()
-	if !o.Parallel {
-		maxWorkers = 1
-	}
-
-	opwg := sync.WaitGroup{}
-	opwg.Add(maxWorkers)
-
-	for wid := 0; wid < maxWorkers; wid++ {
-		worker := o.Gen.GetWorker()
-		go func() {
-			defer opwg.Done()
-			o.runWorker(worker, o.Out())
-		}()
-	}
-	opwg.Wait()
+	o.runPool(o.startErrors(ctx), func(ctx context.Context, worker Worker, _ int, retire <-chan bool) bool {
+		return o.runWorker(ctx, worker, o.Out(), retire)
+	})
 	o.Exit()
 	//stop or close here?
-	return nil
+	return o.exitErr()
 }
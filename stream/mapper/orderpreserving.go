@@ -1,6 +1,6 @@
 package mapper
 
-import "runtime"
+import "context"
 import "sync"
 import "github.com/cloudflare/go-stream/stream"
 
@@ -9,7 +9,7 @@ import "log"
 func NewOrderedOp(proc interface{}, tn string) *OrderPreservingOp {
 	gen := CallbackGenerator{callback: proc}
 	base := stream.NewBaseInOutOp(stream.CHAN_SLACK)
-	mop := &Op{base, &gen, tn, true}
+	mop := &Op{base, &gen, tn, true, nil, workerPool{}, nil}
 	return NewOrderedOpWrapper(mop)
 }
 
@@ -51,8 +51,9 @@ func (o *OrderPreservingOp) MakeOrdered() stream.ParallelizableOperator {
 	panic("Already Ordered")
 }
 
-func (o *OrderPreservingOp) runWorker(worker Worker, workerid int) {
+func (o *OrderPreservingOp) runWorker(ctx context.Context, worker Worker, workerid int, retire <-chan bool) bool {
 	outputer := NewOrderPreservingOutputer(o.results[workerid], o.resultsNum[workerid])
+	mapOutputer := o.instrumentOutputer(outputer)
 	for {
 		<-o.lock
 		select {
@@ -61,7 +62,7 @@ func (o *OrderPreservingOp) runWorker(worker Worker, workerid int) {
 				o.resultQ <- workerid
 				o.lock <- true
 				outputer.sent = false
-				worker.Map(obj, outputer)
+				o.process(ctx, worker, obj, mapOutputer)
 				if !outputer.sent {
 					o.resultsNum[workerid] <- 0
 				}
@@ -69,34 +70,103 @@ func (o *OrderPreservingOp) runWorker(worker Worker, workerid int) {
 				o.resultQ <- workerid
 				o.lock <- true
 				outputer.sent = false
-				o.WorkerClose(worker, outputer)
+				o.WorkerClose(worker, mapOutputer)
 				if !outputer.sent {
 					o.resultsNum[workerid] <- 0
 				}
-				return
+				return false
+			}
+		case <-retire:
+			//the final items of the worker take its place in the output order
+			o.resultQ <- workerid
+			o.lock <- true
+			outputer.sent = false
+			o.WorkerClose(worker, mapOutputer)
+			if !outputer.sent {
+				o.resultsNum[workerid] <- 0
 			}
+			return true
 		case <-o.StopNotifier:
 			o.WorkerStop(worker)
 			o.lock <- true
-			return
+			return false
+		case <-ctx.Done():
+			o.WorkerStop(worker)
+			o.lock <- true
+			return false
 		}
 
 	}
 }
 
+// Pending also counts the results waiting for their turn in the output order
+func (o *OrderPreservingOp) Pending() int {
+	n := o.Op.Pending()
+	for _, results := range o.results {
+		n += len(results)
+	}
+	return n
+}
+
 func (p *OrderPreservingOp) Combiner() {
+	failed := p.onError.failed
 	for workerid := range p.resultQ {
-		num_entries := <-p.resultsNum[workerid]
+		var num_entries int
+		select {
+		case num_entries = <-p.resultsNum[workerid]:
+		case <-failed:
+			p.discard()
+			return
+		}
 		for l := 0; l < num_entries; l++ {
-			val, ok := <-p.results[workerid]
-			if !ok {
-				log.Panic("Should never get a closed channel here")
+			select {
+			case val, ok := <-p.results[workerid]:
+				if !ok {
+					log.Panic("Should never get a closed channel here")
+				}
+				p.Out() <- val
+			case <-failed:
+				p.discard()
+				return
 			}
-			p.Out() <- val
 		}
 	}
 }
 
+// discard drops the results of the workers until they all exit. A worker that panicked may have announced
+// results it never sent, so the combiner can't go on once the op failed.
+func (p *OrderPreservingOp) discard() {
+	done := make(chan bool)
+	wg := sync.WaitGroup{}
+	for i := range p.results {
+		wg.Add(2)
+		go func(results chan stream.Object) {
+			defer wg.Done()
+			for {
+				select {
+				case <-results:
+				case <-done:
+					return
+				}
+			}
+		}(p.results[i])
+		go func(num chan int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-num:
+				case <-done:
+					return
+				}
+			}
+		}(p.resultsNum[i])
+	}
+	for range p.resultQ {
+	}
+	close(done)
+	wg.Wait()
+}
+
 func (proc *OrderPreservingOp) InitiateWorkerChannels(numWorkers int) {
 	//results holds the result for each worker so [workerid] chan RESULTTYPE
 	proc.results = make([]chan stream.Object, numWorkers)
@@ -117,27 +187,17 @@ func (proc *OrderPreservingOp) InitiateWorkerChannels(numWorkers int) {
 }
 
 func (o *OrderPreservingOp) Run() error {
+	return o.RunContext(context.Background())
+}
+
+func (o *OrderPreservingOp) RunContext(ctx context.Context) error {
 	defer close(o.Out())
 	//perform some validation
 	//Processor.Validate()
 
-	maxWorkers := runtime.NumCPU()
-	if !o.Parallel {
-		maxWorkers = 1
-	}
+	_, maxWorkers := o.poolBounds()
 	o.InitiateWorkerChannels(maxWorkers)
-
-	opwg := sync.WaitGroup{}
-	opwg.Add(maxWorkers)
-
-	for wid := 0; wid < maxWorkers; wid++ {
-		workerid := wid
-		worker := o.Gen.GetWorker()
-		go func() {
-			defer opwg.Done()
-			o.runWorker(worker, workerid)
-		}()
-	}
+	ctx = o.startErrors(ctx)
 
 	combinerwg := sync.WaitGroup{}
 	combinerwg.Add(1)
@@ -145,11 +205,11 @@ func (o *OrderPreservingOp) Run() error {
 		defer combinerwg.Done()
 		o.Combiner()
 	}()
-	opwg.Wait()
+	o.runPool(ctx, o.runWorker)
 	//log.Println("Workers Returned Order Pres")
 	close(o.resultQ)
 	combinerwg.Wait()
 	o.Exit()
 	//stop or close here?
-	return nil
+	return o.exitErr()
 }
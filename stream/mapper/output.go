@@ -1,6 +1,7 @@
 package mapper
 
 import "github.com/cloudflare/go-stream/stream"
+import "github.com/cloudflare/go-stream/util"
 
 type Outputer interface {
 	Out(int) chan<- stream.Object
@@ -17,3 +18,14 @@ func (o *SimpleOutputer) Out(num int) chan<- stream.Object {
 func NewSimpleOutputer(ch chan<- stream.Object) Outputer {
 	return &SimpleOutputer{ch}
 }
+
+// countingOutputer counts the objects announced through Out in the Out metric
+type countingOutputer struct {
+	Outputer
+	metrics *util.MetricsGroup
+}
+
+func (o *countingOutputer) Out(num int) chan<- stream.Object {
+	o.metrics.Out.Inc(int64(num))
+	return o.Outputer.Out(num)
+}
@@ -0,0 +1,143 @@
+package mapper
+
+import (
+	"context"
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util/slog"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// workerPool is the worker configuration of an op. Without autoscaling it runs max workers,
+// runtime.NumCPU() if unset.
+type workerPool struct {
+	max      int
+	min      int
+	interval time.Duration //autoscaling period, 0 disables autoscaling
+	running  int64         //atomic
+	inflight int64         //atomic, objects being mapped by the workers
+}
+
+type workerExit struct {
+	id      int
+	retired bool
+}
+
+// SetWorkers sets the number of workers of a parallel op, disabling autoscaling
+func (o *Op) SetWorkers(n int) *Op {
+	if n < 1 {
+		slog.Logf(logger.Levels.Error, "Invalid number of workers %d for %s, using 1", n, o.Typename)
+		n = 1
+	}
+	o.pool.max = n
+	o.pool.min = n
+	o.pool.interval = 0
+	return o
+}
+
+// SetAutoscale runs between min and max workers. Every interval a worker is added while more objects
+// than workers wait in the input, and one is retired when the input is empty. Retired workers are closed
+// like on a soft close.
+func (o *Op) SetAutoscale(min int, max int, interval time.Duration) *Op {
+	if min < 1 || max < min || interval <= 0 {
+		slog.Logf(logger.Levels.Error, "Invalid autoscaling %d-%d every %v for %s, ignoring", min, max, interval, o.Typename)
+		return o
+	}
+	o.pool.max = max
+	o.pool.min = min
+	o.pool.interval = interval
+	return o
+}
+
+// Workers is the number of running workers
+func (o *Op) Workers() int {
+	return int(atomic.LoadInt64(&o.pool.running))
+}
+
+// Pending counts the objects in the input channel and the ones the workers are mapping
+func (o *Op) Pending() int {
+	return o.GetInDepth() + int(atomic.LoadInt64(&o.pool.inflight))
+}
+
+// process maps obj, counting it as in flight until the worker is done with it
+func (o *Op) process(ctx context.Context, worker Worker, obj stream.Object, out Outputer) {
+	atomic.AddInt64(&o.pool.inflight, 1)
+	defer atomic.AddInt64(&o.pool.inflight, -1)
+	start := time.Now()
+	o.mapItem(ctx, worker, obj, out)
+	o.recordItem(start)
+}
+
+func (o *Op) poolBounds() (int, int) {
+	if !o.Parallel {
+		return 1, 1
+	}
+	max := o.pool.max
+	if max == 0 {
+		max = runtime.NumCPU()
+	}
+	if o.pool.interval == 0 {
+		return max, max
+	}
+	return o.pool.min, max
+}
+
+// runPool runs the workers, numbered below max, and scales them until they all exit.
+// run returns true when the worker exited because it was retired.
+func (o *Op) runPool(ctx context.Context, run func(ctx context.Context, worker Worker, workerid int, retire <-chan bool) bool) {
+	min, max := o.poolBounds()
+	exits := make(chan workerExit)
+	retire := make(chan bool)
+	free := make([]int, 0, max)
+	for id := max - 1; id >= 0; id-- {
+		free = append(free, id)
+	}
+
+	running := 0
+	start := func() {
+		id := free[len(free)-1]
+		free = free[:len(free)-1]
+		running++
+		atomic.StoreInt64(&o.pool.running, int64(running))
+		worker := o.Gen.GetWorker()
+		go func() {
+			exits <- workerExit{id, run(ctx, worker, id, retire)}
+		}()
+	}
+	for running < min {
+		start()
+	}
+
+	var tick <-chan time.Time
+	if o.pool.interval > 0 && min < max {
+		ticker := time.NewTicker(o.pool.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for running > 0 {
+		select {
+		case exit := <-exits:
+			running--
+			atomic.StoreInt64(&o.pool.running, int64(running))
+			free = append(free, exit.id)
+			if !exit.retired {
+				//closing or stopping, the other workers follow
+				tick = nil
+			}
+		case <-tick:
+			depth := o.GetInDepth()
+			if depth > running && running < max {
+				start()
+			} else if depth == 0 && running > min {
+				//only an idle worker takes it
+				select {
+				case retire <- true:
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package mapper
+
+import "github.com/cloudflare/go-stream/stream"
+
+// Map creates a typed op applying fn to every input. It uses the EfficientWorker fast path, no reflection.
+func Map[In, Out any](fn func(In) Out, tn string) *stream.TypedOp[In, Out] {
+	callback := func(obj stream.Object, out Outputer) {
+		out.Out(1) <- fn(obj.(In))
+	}
+	return stream.AsOp[In, Out](NewOp(callback, tn))
+}
+
+// MapOrdered is Map with the order of the input preserved on the output
+func MapOrdered[In, Out any](fn func(In) Out, tn string) *stream.TypedOp[In, Out] {
+	callback := func(obj stream.Object, out Outputer) {
+		out.Out(1) <- fn(obj.(In))
+	}
+	return stream.AsOp[In, Out](NewOrderedOp(callback, tn))
+}
+
+// MapErr is Map with a function that may fail. The failures are handled by the error policy of the op,
+// set through Operator().(*Op).
+func MapErr[In, Out any](fn func(In) (Out, error), tn string) *stream.TypedOp[In, Out] {
+	callback := func(obj stream.Object, out Outputer) error {
+		res, err := fn(obj.(In))
+		if err != nil {
+			return err
+		}
+		out.Out(1) <- res
+		return nil
+	}
+	return stream.AsOp[In, Out](NewOpErr(callback, tn))
+}
+
+// Keyed is the output of KeyBy
+type Keyed[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// Filter creates a typed op passing on the inputs for which pred is true.
+// Like all the helpers below, it is made order preserving when added to an ordered chain.
+func Filter[T any](pred func(T) bool, tn string) *stream.TypedOp[T, T] {
+	callback := func(obj stream.Object, out Outputer) {
+		if pred(obj.(T)) {
+			out.Out(1) <- obj
+		}
+	}
+	return stream.AsOp[T, T](NewOp(callback, tn))
+}
+
+// FlatMap creates a typed op sending all the results of fn for every input, possibly none
+func FlatMap[In, Out any](fn func(In) []Out, tn string) *stream.TypedOp[In, Out] {
+	callback := func(obj stream.Object, out Outputer) {
+		res := fn(obj.(In))
+		if len(res) == 0 {
+			return
+		}
+		ch := out.Out(len(res))
+		for _, r := range res {
+			ch <- r
+		}
+	}
+	return stream.AsOp[In, Out](NewOp(callback, tn))
+}
+
+// KeyBy creates a typed op pairing every input with its key
+func KeyBy[K comparable, V any](key func(V) K, tn string) *stream.TypedOp[V, Keyed[K, V]] {
+	callback := func(obj stream.Object, out Outputer) {
+		v := obj.(V)
+		out.Out(1) <- Keyed[K, V]{key(v), v}
+	}
+	return stream.AsOp[V, Keyed[K, V]](NewOp(callback, tn))
+}
+
+// Tap creates a typed op calling fn on every input and passing it on unchanged
+func Tap[T any](fn func(T), tn string) *stream.TypedOp[T, T] {
+	callback := func(obj stream.Object, out Outputer) {
+		fn(obj.(T))
+		out.Out(1) <- obj
+	}
+	return stream.AsOp[T, T](NewOp(callback, tn))
+}
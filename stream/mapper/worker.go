@@ -108,3 +108,19 @@ func (w *EfficientWorker) Validate(inCh chan stream.Object, typeName string) boo
 	slog.Logf(logger.Levels.Info, "Checking %s", typeName)
 	return true
 }
+
+// EfficientErrorWorker is the EfficientWorker of callbacks returning an error
+type EfficientErrorWorker struct {
+	EfficientWorker
+	errCallback func(obj stream.Object, out Outputer) error
+}
+
+func (w *EfficientErrorWorker) Map(input stream.Object, out Outputer) {
+	if err := w.errCallback(input, out); err != nil {
+		slog.Logf(logger.Levels.Error, "%s error: %v", w.typename, err)
+	}
+}
+
+func (w *EfficientErrorWorker) MapErr(input stream.Object, out Outputer) error {
+	return w.errCallback(input, out)
+}
@@ -0,0 +1,236 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util"
+	"github.com/cloudflare/go-stream/util/slog"
+	"sync"
+	"time"
+)
+
+type mergeChildOp interface {
+	Operator
+	Out
+}
+
+// MergeOperator runs several upstream operators or chains and multiplexes their outputs into its own.
+// The output is closed once all the inputs are closed. It has no input, so it starts a chain.
+type MergeOperator struct {
+	*HardStopChannelCloser
+	*BaseOut
+	inputs  []chan Object
+	runner  *Runner
+	buffer  int
+	key     func(Object) int64
+	metrics *util.MetricsGroup
+}
+
+func NewMergeOp() *MergeOperator {
+	return &MergeOperator{NewHardStopChannelCloser(), NewBaseOut(CHAN_SLACK), make([]chan Object, 0, 2), NewRunner(), CHAN_SLACK, nil, nil}
+}
+
+// SetBuffer sets the capacity of the channels of the inputs added by subsequent calls to Add
+func (op *MergeOperator) SetBuffer(n int) *MergeOperator {
+	op.buffer = n
+	return op
+}
+
+// SetOrderKey merges the inputs by key, e.g. a timestamp: if every input is sorted by key, so is the output.
+// An object is only sent once every open input has one waiting, so an idle input holds back the others.
+func (op *MergeOperator) SetOrderKey(key func(Object) int64) *MergeOperator {
+	op.key = key
+	return op
+}
+
+func (op *MergeOperator) Add(newOp mergeChildOp) {
+	op.AddWithBuffer(newOp, op.buffer)
+}
+
+// AddWithBuffer adds an input whose channel to the merge has capacity n
+func (op *MergeOperator) AddWithBuffer(newOp mergeChildOp, n int) {
+	ch := make(chan Object, n)
+	newOp.SetOut(ch)
+	op.inputs = append(op.inputs, ch)
+	op.runner.Add(newOp)
+}
+
+func (op *MergeOperator) SetMetrics(m *util.MetricsGroup) {
+	op.metrics = m
+}
+
+func (op *MergeOperator) Inputs() []Operator {
+	return op.runner.Operators()
+}
+
+func (op *MergeOperator) Run() error {
+	return op.RunContext(context.Background())
+}
+
+func (op *MergeOperator) RunContext(ctx context.Context) error {
+	defer op.runner.Wait()
+	op.runner.AsyncRunAllContext(ctx)
+	defer close(op.Out())
+
+	var err error
+	if op.key == nil {
+		err = op.multiplex(ctx)
+	} else {
+		err = op.mergeOrdered(ctx)
+	}
+	if err != nil {
+		op.runner.HardStop()
+		op.runner.WaitGroup().Wait()
+		return errors.Join(err, op.runner.Err())
+	}
+	//an input may have failed and closed its output before the merge noticed
+	op.runner.Wait()
+	return op.runner.Err()
+}
+
+// interrupted hard stops the inputs if the merge was stopped, or returns an error if an input failed
+func (op *MergeOperator) interrupted(ctx context.Context) error {
+	select {
+	case <-op.StopNotifier:
+	case <-ctx.Done():
+	default:
+		slog.Logf(logger.Levels.Error, "Input failed in merge op")
+		return errors.New("Merge input failed")
+	}
+	op.runner.HardStop()
+	return nil
+}
+
+func (op *MergeOperator) multiplex(ctx context.Context) error {
+	abort := make(chan bool)
+	var wg sync.WaitGroup
+	for _, in := range op.inputs {
+		wg.Add(1)
+		go func(in chan Object) {
+			defer wg.Done()
+			for {
+				//an idle input must not keep the merge from stopping
+				var obj Object
+				select {
+				case o, ok := <-in:
+					if !ok {
+						return
+					}
+					obj = o
+				case <-abort:
+					return
+				}
+				start := time.Now()
+				select {
+				case op.Out() <- obj:
+					recordItem(op.metrics, start)
+					recordOut(op.metrics, 1)
+				case <-abort:
+					return
+				}
+			}
+		}(in)
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-op.StopNotifier:
+	case <-ctx.Done():
+	case <-op.runner.ErrorChannel():
+	}
+	close(abort)
+	<-done
+	return op.interrupted(ctx)
+}
+
+func (op *MergeOperator) mergeOrdered(ctx context.Context) error {
+	heads := make([]Object, len(op.inputs))
+	full := make([]bool, len(op.inputs))
+	open := make([]bool, len(op.inputs))
+	for i := range open {
+		open[i] = true
+	}
+
+	for {
+		for i, in := range op.inputs {
+			if !open[i] || full[i] {
+				continue
+			}
+			select {
+			case obj, ok := <-in:
+				if ok {
+					heads[i], full[i] = obj, true
+				} else {
+					open[i] = false
+				}
+			case <-op.StopNotifier:
+				return op.interrupted(ctx)
+			case <-ctx.Done():
+				return op.interrupted(ctx)
+			case <-op.runner.ErrorChannel():
+				return op.interrupted(ctx)
+			}
+		}
+
+		start := time.Now()
+		min := -1
+		for i := range heads {
+			if full[i] && (min < 0 || op.key(heads[i]) < op.key(heads[min])) {
+				min = i
+			}
+		}
+		if min < 0 {
+			return nil
+		}
+		select {
+		case op.Out() <- heads[min]:
+			heads[min], full[min] = nil, false
+			recordItem(op.metrics, start)
+			recordOut(op.metrics, 1)
+		case <-op.StopNotifier:
+			return op.interrupted(ctx)
+		case <-ctx.Done():
+			return op.interrupted(ctx)
+		}
+	}
+}
+
+func (op *MergeOperator) Pending() int {
+	n := 0
+	for _, in := range op.inputs {
+		n += len(in)
+	}
+	return n + pendingOfAll(op.runner.Operators())
+}
+
+type OutChain interface {
+	Chain
+	Out
+}
+
+type outChain struct {
+	Chain
+}
+
+// NewOutChainWrapper lets a chain without a sink feed another operator, e.g. a merge, through its last operator's output
+func NewOutChainWrapper(c Chain) OutChain {
+	return &outChain{c}
+}
+
+func (c *outChain) Out() chan Object {
+	ops := c.Operators()
+	return ops[len(ops)-1].(Out).Out()
+}
+
+func (c *outChain) SetOut(ch chan Object) {
+	ops := c.Operators()
+	ops[len(ops)-1].(Out).SetOut(ch)
+}
@@ -0,0 +1,63 @@
+package stream
+
+import (
+	"github.com/cloudflare/go-stream/util"
+	"github.com/cloudflare/go-stream/util/slog"
+	"time"
+)
+
+// How often the runner samples the input queue depth of the operators it runs
+const METRICS_POLL_INTERVAL = time.Second
+
+// Instrumented is implemented by operators that record their own per-item metrics (items in and out,
+// processing latency). The runner hands them their metrics group before running them.
+type Instrumented interface {
+	SetMetrics(m *util.MetricsGroup)
+}
+
+// instrument registers op with slog.Gm and polls its input queue depth until the returned function is called.
+// It returns a nil group if metrics were not initialized.
+func instrument(op Operator) (*util.MetricsGroup, func()) {
+	if slog.Gm == nil {
+		return nil, func() {}
+	}
+	group := slog.Gm.Register(Name(op))
+	if inst, ok := op.(Instrumented); ok {
+		inst.SetMetrics(&group)
+	}
+
+	in, ok := op.(In)
+	if !ok {
+		return &group, func() {}
+	}
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(METRICS_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			group.QueueLength.Update(int64(in.GetInDepth()))
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return &group, func() {
+		close(done)
+	}
+}
+
+// recordItem counts an item in and its processing time; m may be nil
+func recordItem(m *util.MetricsGroup, start time.Time) {
+	if m != nil {
+		m.In.Inc(1)
+		m.Latency.Update(int64(time.Since(start)))
+	}
+}
+
+func recordOut(m *util.MetricsGroup, n int) {
+	if m != nil {
+		m.Out.Inc(int64(n))
+	}
+}
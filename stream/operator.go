@@ -2,6 +2,7 @@
 package stream
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 )
@@ -27,6 +28,28 @@ type Operator interface {
 	Stop() error
 }
 
+// ContextOperator is an operator that can also be run bound to a context. When ctx is done RunContext
+// should behave as if Stop was called: return nil after all the goroutines it started have quit.
+type ContextOperator interface {
+	Operator
+	RunContext(ctx context.Context) error
+}
+
+// RunContext runs op until it exits on its own or ctx is done, in which case op is hard stopped.
+// As with a hard stop, cancellation is not an error of op; check ctx.Err() to tell the cases apart.
+// The caller may still stop op, whose Stop is then called twice: the Stop of HardStopChannelCloser
+// allows it, operators implementing their own must too.
+func RunContext(ctx context.Context, op Operator) error {
+	if cop, ok := op.(ContextOperator); ok {
+		return cop.RunContext(ctx)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		op.Stop()
+	})
+	defer stop()
+	return op.Run()
+}
+
 type ParallelizableOperator interface {
 	Operator
 	IsParallel() bool
@@ -58,3 +81,17 @@ func Name(op Operator) string {
 	}
 	return reflect.TypeOf(op).String()
 }
+
+// OpError is an error returned by an operator, tagged with the operator's name.
+type OpError struct {
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
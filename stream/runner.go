@@ -1,26 +1,37 @@
 package stream
 
 import (
+	"context"
+	"errors"
 	"github.com/cloudflare/golog/logger"
 	"github.com/cloudflare/go-stream/util/slog"
+	"reflect"
 	"sync"
 )
 
 type Runner struct {
 	ops           []Operator
+	stopped       []bool
+	retired       []*retiredOp
 	closenotifier chan bool
 	errors        chan error
+	errs          []error
+	ctx           context.Context
+	ctxErr        error
+	detach        func() bool
+	lock          sync.Mutex
 	wg            *sync.WaitGroup
 }
 
 func NewRunner() *Runner {
-	return &Runner{make([]Operator, 0, 2), make(chan bool), make(chan error, 1), &sync.WaitGroup{}}
+	return &Runner{ops: make([]Operator, 0, 2), closenotifier: make(chan bool), errors: make(chan error, 1), ctx: context.Background(), wg: &sync.WaitGroup{}}
 }
 
 func (r *Runner) WaitGroup() *sync.WaitGroup {
 	return r.wg
 }
 
+// ErrorChannel receives the first error returned by an operator. Use Errors or Err to get all of them.
 func (r *Runner) ErrorChannel() <-chan error {
 	return r.errors
 }
@@ -30,43 +41,234 @@ func (r *Runner) CloseNotifier() <-chan bool {
 }
 
 func (r *Runner) Operators() []Operator {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.ops
 }
 
+// SetContext ties the runner to ctx: once ctx is done all operators are hard stopped.
+// Operators implementing ContextOperator started after this call are run with ctx.
+func (r *Runner) SetContext(ctx context.Context) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.detach != nil {
+		r.detach()
+	}
+	r.ctx = ctx
+	r.detach = context.AfterFunc(ctx, func() {
+		r.lock.Lock()
+		r.ctxErr = ctx.Err()
+		r.lock.Unlock()
+		r.HardStop()
+	})
+}
+
+func (r *Runner) context() context.Context {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ctx
+}
+
+func (r *Runner) addError(op Operator, err error) {
+	opErr := &OpError{Name(op), err}
+	r.lock.Lock()
+	r.errs = append(r.errs, opErr)
+	r.lock.Unlock()
+	select {
+	case r.errors <- opErr:
+	default:
+	}
+}
+
+// Errors returns every error returned by an operator so far, each wrapped in an *OpError.
+func (r *Runner) Errors() []error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]error(nil), r.errs...)
+}
+
+// Err joins the errors of all the operators and the context error if the runner was cancelled.
+func (r *Runner) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	errs := append([]error(nil), r.errs...)
+	if r.ctxErr != nil {
+		errs = append(errs, r.ctxErr)
+	}
+	return errors.Join(errs...)
+}
+
 func (r *Runner) AsyncRun(op Operator) {
+	ctx := r.context()
 	r.wg.Add(1)
 	go func() {
 		defer r.wg.Done()
-		err := op.Run()
+		metrics, stopMetrics := instrument(op)
+		var err error
+		if cop, ok := op.(ContextOperator); ok {
+			err = withoutContextErr(cop.RunContext(ctx), ctx)
+		} else {
+			err = op.Run()
+		}
+		stopMetrics()
 		if err != nil {
 			slog.Logf(logger.Levels.Error, "Got an err from a child in runner: %v", err)
-			select {
-			case r.errors <- err:
-			default:
+			if metrics != nil {
+				metrics.Errors.Inc(1)
 			}
+			r.addError(op, err)
 		}
 		//on first exit, the cn channel is closed
+		r.lock.Lock()
+		if r.removeRetired(op) {
+			r.lock.Unlock()
+			return
+		}
 		select {
 		case <-r.closenotifier: //if already closed no-op
 		default:
 			close(r.closenotifier)
 		}
+		r.lock.Unlock()
 	}()
 }
 
 func (r *Runner) Add(op Operator) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	r.ops = append(r.ops, op)
+	r.stopped = append(r.stopped, false)
+}
+
+type retiredOp struct {
+	op      Operator
+	stopped bool
+	exited  chan bool
+}
+
+func sameOp(a Operator, b Operator) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// retirable tells whether Retire can find op, which must be of a comparable type
+func retirable(op Operator) bool {
+	return reflect.TypeOf(op).Comparable()
+}
+
+// Retire removes a running op from the runner: it is no longer listed by Operators and its exit is not
+// reported by CloseNotifier, but Wait still waits for it and HardStop still stops it.
+// op must be of a comparable type (e.g. a pointer). The returned channel is closed once op exited, it is
+// nil if op isn't found.
+func (r *Runner) Retire(op Operator) <-chan bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, o := range r.ops {
+		if sameOp(o, op) {
+			exited := make(chan bool)
+			r.retired = append(r.retired, &retiredOp{o, r.stopped[i], exited})
+			r.ops = append(r.ops[:i:i], r.ops[i+1:]...)
+			r.stopped = append(r.stopped[:i:i], r.stopped[i+1:]...)
+			return exited
+		}
+	}
+	return nil
+}
+
+// removeRetired forgets op once it exited, must be called with the lock held
+func (r *Runner) removeRetired(op Operator) bool {
+	for i, ro := range r.retired {
+		if sameOp(ro.op, op) {
+			r.retired = append(r.retired[:i], r.retired[i+1:]...)
+			close(ro.exited)
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Runner) AsyncRunAll() {
-	for _, op := range r.ops {
+	for _, op := range r.Operators() {
 		r.AsyncRun(op)
 	}
 }
 
+func (r *Runner) AsyncRunAllContext(ctx context.Context) {
+	r.SetContext(ctx)
+	r.AsyncRunAll()
+}
+
+// stop calls Stop on the i-th operator unless the runner already did so.
+func (r *Runner) stop(i int) {
+	r.lock.Lock()
+	if i >= len(r.ops) || r.stopped[i] {
+		r.lock.Unlock()
+		return
+	}
+	r.stopped[i] = true
+	op := r.ops[i]
+	r.lock.Unlock()
+	op.Stop()
+}
+
+// SoftStop stops the first operator, letting the rest close as their input closes.
+func (r *Runner) SoftStop() {
+	r.stop(0)
+}
+
 func (r *Runner) HardStop() {
-	for _, op := range r.ops {
+	for i := range r.Operators() {
+		r.stop(i)
+	}
+
+	r.lock.Lock()
+	retired := make([]Operator, 0, len(r.retired))
+	for _, ro := range r.retired {
+		if !ro.stopped {
+			ro.stopped = true
+			retired = append(retired, ro.op)
+		}
+	}
+	r.lock.Unlock()
+	for _, op := range retired {
 		op.Stop()
 	}
+}
+
+// Wait waits for all the operators to exit and releases the context set with SetContext.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.detach != nil {
+		r.detach()
+		r.detach = nil
+		//context operators may all exit on ctx.Done before the AfterFunc got to record the error
+		if r.ctxErr == nil {
+			r.ctxErr = r.ctx.Err()
+		}
+	}
+}
 
+// withoutContextErr strips ctx's own error from err. A cancelled child chain reports the
+// cancellation, which the parent runner already reports once in Err.
+func withoutContextErr(err error, ctx context.Context) error {
+	ctxErr := ctx.Err()
+	if err == nil || ctxErr == nil {
+		return err
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		if err == ctxErr {
+			return nil
+		}
+		return err
+	}
+	errs := make([]error, 0, len(joined.Unwrap()))
+	for _, e := range joined.Unwrap() {
+		if e != ctxErr {
+			errs = append(errs, e)
+		}
+	}
+	return errors.Join(errs...)
 }
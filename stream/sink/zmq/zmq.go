@@ -1,9 +1,5 @@
 package zmq
 
-import (
-	"log"
-)
-
 import "github.com/cloudflare/go-stream/stream/sink"
 import "github.com/cloudflare/go-stream/stream"
 
@@ -30,7 +26,6 @@ func (con ZmqSink) Run() error {
 	//reference: https://groups.google.com/forum/#!topic/golang-nuts/eABYrBA5LEk
 	socket, err := zmqapi.NewSocket(zmqapi.PUSH)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 	defer socket.Close()
@@ -38,7 +33,6 @@ func (con ZmqSink) Run() error {
 	socket.SetSndhwm(con.hwm)
 	err = socket.Connect(con.addr)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
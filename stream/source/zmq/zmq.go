@@ -34,14 +34,13 @@ func (src ZmqSource) Run() error {
 
 	socket, err := zmqapi.NewSocket(zmqapi.PULL)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer socket.Close()
 
 	socket.SetRcvhwm(src.hwm)
 	err = socket.Bind(src.addr)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var ErrSpillClosed = errors.New("Spill queue is closed")
+
+// spillQueue is an unbounded FIFO of objects backed by a file. Objects are length prefixed;
+// the file is truncated every time the queue empties so it only grows while a consumer is behind.
+type spillQueue struct {
+	file     *os.File
+	encode   func(Object) ([]byte, error)
+	decode   func([]byte) (Object, error)
+	readOff  int64
+	writeOff int64
+	count    int //objects pushed and not yet delivered
+	closed   bool
+	lock     sync.Mutex
+	cond     *sync.Cond
+}
+
+func newSpillQueue(dir string, encode func(Object) ([]byte, error), decode func([]byte) (Object, error)) (*spillQueue, error) {
+	file, err := os.CreateTemp(dir, "go-stream-spill-")
+	if err != nil {
+		return nil, err
+	}
+	if encode == nil {
+		encode = encodeBytes
+	}
+	if decode == nil {
+		decode = decodeBytes
+	}
+	q := &spillQueue{file: file, encode: encode, decode: decode}
+	q.cond = sync.NewCond(&q.lock)
+	return q, nil
+}
+
+func encodeBytes(obj Object) ([]byte, error) {
+	b, ok := obj.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("Cannot spill object of type %T without an encoder", obj)
+	}
+	return b, nil
+}
+
+func decodeBytes(b []byte) (Object, error) {
+	return b, nil
+}
+
+func (q *spillQueue) Push(obj Object) error {
+	b, err := q.encode(obj)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, binary.MaxVarintLen64+len(b))
+	n := binary.PutUvarint(rec, uint64(len(b)))
+	n += copy(rec[n:], b)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrSpillClosed
+	}
+	if _, err := q.file.WriteAt(rec[:n], q.writeOff); err != nil {
+		return err
+	}
+	q.writeOff += int64(n)
+	q.count++
+	q.cond.Signal()
+	return nil
+}
+
+// Pop blocks until an object is available and returns it, or returns false once the queue is closed and empty.
+// The object still counts in Len until Delivered is called, so that producers keep spilling behind it.
+func (q *spillQueue) Pop() (Object, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.readOff == q.writeOff {
+		if q.closed {
+			return nil, false, nil
+		}
+		q.cond.Wait()
+	}
+
+	var hdr [binary.MaxVarintLen64]byte
+	n, err := q.file.ReadAt(hdr[:], q.readOff)
+	if n == 0 {
+		return nil, false, err
+	}
+	size, hlen := binary.Uvarint(hdr[:n])
+	if hlen <= 0 {
+		return nil, false, errors.New("Corrupt spill record")
+	}
+	b := make([]byte, size)
+	if _, err := q.file.ReadAt(b, q.readOff+int64(hlen)); err != nil {
+		return nil, false, err
+	}
+	q.readOff += int64(hlen) + int64(size)
+	obj, err := q.decode(b)
+	return obj, true, err
+}
+
+func (q *spillQueue) Delivered() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.count--
+	if q.count == 0 && q.readOff == q.writeOff {
+		q.readOff, q.writeOff = 0, 0
+		q.file.Truncate(0)
+	}
+}
+
+func (q *spillQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.count
+}
+
+// Close stops accepting objects, Pop returns the ones already spilled.
+func (q *spillQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *spillQueue) Remove() error {
+	q.file.Close()
+	return os.Remove(q.file.Name())
+}
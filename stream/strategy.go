@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// DistributionStrategy spreads objects over a fixed set of branches numbered 0 to NumBranches()-1.
+// The constructors below return a *StrategyError if n is not positive.
+// Pick is only called from the distributor goroutine; depth returns the number of objects waiting
+// in the input channel of a branch.
+type DistributionStrategy interface {
+	NumBranches() int
+	Pick(obj Object, depth func(branch int) int) int
+}
+
+// NewStrategyDistributor creates a distributor whose branches, keyed by their number, are all created through
+// creator when it starts and receive objects as picked by strategy.
+func NewStrategyDistributor(strategy DistributionStrategy, creator func(DistribKey) DistributorChildOp) *DistributeOperator {
+	op := NewDistributor(nil, creator)
+	op.strategy = strategy
+	op.mapper = func(obj Object) DistribKey {
+		return strategy.Pick(obj, op.branchDepth)
+	}
+	return op
+}
+
+func (op *DistributeOperator) branchDepth(branch int) int {
+	if e, ok := op.outputs[branch]; ok {
+		return e.Value.(*distribBranch).op.GetInDepth()
+	}
+	return 0
+}
+
+// hashKey is FNV-1a followed by the murmur3 finalizer, FNV alone spreads short similar keys poorly
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// StrategyError is a strategy argument that has to be positive
+type StrategyError struct {
+	Arg   string
+	Value int
+}
+
+func (e *StrategyError) Error() string {
+	return fmt.Sprintf("Distribution strategy needs a positive number of %s, got %d", e.Arg, e.Value)
+}
+
+// checkBranches refuses a branch count the strategies can't pick from
+func checkBranches(n int) error {
+	if n <= 0 {
+		return &StrategyError{"branches", n}
+	}
+	return nil
+}
+
+type hashStrategy struct {
+	n   int
+	key func(Object) string
+}
+
+// NewHashStrategy partitions objects over n branches by the hash of their key
+func NewHashStrategy(n int, key func(Object) string) (DistributionStrategy, error) {
+	if err := checkBranches(n); err != nil {
+		return nil, err
+	}
+	return &hashStrategy{n, key}, nil
+}
+
+func (s *hashStrategy) NumBranches() int {
+	return s.n
+}
+
+func (s *hashStrategy) Pick(obj Object, _ func(int) int) int {
+	return int(hashKey(s.key(obj)) % uint32(s.n))
+}
+
+type ringPoint struct {
+	hash   uint32
+	branch int
+}
+
+type consistentHashStrategy struct {
+	n    int
+	key  func(Object) string
+	ring []ringPoint
+}
+
+// NewConsistentHashStrategy places vnodes virtual nodes per branch on a hash ring, so that changing n
+// only moves the keys of about 1/n of the ring
+func NewConsistentHashStrategy(n int, vnodes int, key func(Object) string) (DistributionStrategy, error) {
+	if err := checkBranches(n); err != nil {
+		return nil, err
+	}
+	if vnodes <= 0 {
+		return nil, &StrategyError{"virtual nodes", vnodes}
+	}
+	ring := make([]ringPoint, 0, n*vnodes)
+	for b := 0; b < n; b++ {
+		for v := 0; v < vnodes; v++ {
+			ring = append(ring, ringPoint{hashKey(fmt.Sprintf("%d-%d", b, v)), b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return &consistentHashStrategy{n, key, ring}, nil
+}
+
+func (s *consistentHashStrategy) NumBranches() int {
+	return s.n
+}
+
+func (s *consistentHashStrategy) Pick(obj Object, _ func(int) int) int {
+	h := hashKey(s.key(obj))
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].branch
+}
+
+type roundRobinStrategy struct {
+	n    int
+	next int
+}
+
+// NewRoundRobinStrategy sends objects to each of the n branches in turn
+func NewRoundRobinStrategy(n int) (DistributionStrategy, error) {
+	if err := checkBranches(n); err != nil {
+		return nil, err
+	}
+	return &roundRobinStrategy{n, 0}, nil
+}
+
+func (s *roundRobinStrategy) NumBranches() int {
+	return s.n
+}
+
+func (s *roundRobinStrategy) Pick(_ Object, _ func(int) int) int {
+	b := s.next
+	s.next = (s.next + 1) % s.n
+	return b
+}
+
+type leastDepthStrategy struct {
+	n int
+}
+
+// NewLeastDepthStrategy sends each object to the branch with the fewest objects waiting in its input,
+// the lowest numbered one on ties
+func NewLeastDepthStrategy(n int) (DistributionStrategy, error) {
+	if err := checkBranches(n); err != nil {
+		return nil, err
+	}
+	return &leastDepthStrategy{n}, nil
+}
+
+func (s *leastDepthStrategy) NumBranches() int {
+	return s.n
+}
+
+func (s *leastDepthStrategy) Pick(_ Object, depth func(int) int) int {
+	best, bestDepth := 0, depth(0)
+	for b := 1; b < s.n && bestDepth > 0; b++ {
+		if d := depth(b); d < bestDepth {
+			best, bestDepth = b, d
+		}
+	}
+	return best
+}
@@ -0,0 +1,305 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/golog/logger"
+	"github.com/cloudflare/go-stream/util/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PanicError is a recovered panic, with the stack of the goroutine that panicked
+type PanicError struct {
+	Op    string
+	Value interface{}
+	Stack []byte
+}
+
+// NewPanicError is called from the deferred function recovering the panic, to capture its stack
+func NewPanicError(op string, value interface{}) *PanicError {
+	return &PanicError{op, value, debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Panic in %s: %v", e.Op, e.Value)
+}
+
+type RestartMode int
+
+const (
+	RESTART_NEVER      RestartMode = iota //the first failure is returned
+	RESTART_ON_FAILURE                    //failed operators are replaced by a new one, clean exits are final
+)
+
+var ErrTooManyRestarts = errors.New("Too many restarts")
+
+// RestartPolicy restarts failed operators after Backoff, doubled on every restart up to MaxBackoff. With
+// MaxRestarts set, the supervisor gives up on a failure once MaxRestarts restarts happened within Window,
+// or in total if Window is 0.
+type RestartPolicy struct {
+	Restart     RestartMode
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	MaxRestarts int
+	Window      time.Duration
+}
+
+// SupervisedOperator is returned by NewSupervisor. It has an input and an output if the operators it
+// supervises do.
+type SupervisedOperator interface {
+	ContextOperator
+	Restarts() int
+	Failures() []error
+}
+
+// supervisor runs the operators made by create one at a time, making a new one when the running one fails.
+// An operator is only run once, since it closes its output and stop channel, so the supervisor reads the
+// output of each operator and forwards it to its own.
+type supervisor struct {
+	*HardStopChannelCloser
+	create   func() Operator
+	policy   RestartPolicy
+	name     string
+	in       *BaseIn
+	out      *BaseOut
+	lock     sync.Mutex
+	current  Operator
+	stopped  bool //current was stopped
+	restarts int64
+	failures []error
+}
+
+type inSupervisor struct {
+	*supervisor
+	*BaseIn
+}
+
+type outSupervisor struct {
+	*supervisor
+	*BaseOut
+}
+
+type inOutSupervisor struct {
+	*supervisor
+	*BaseIn
+	*BaseOut
+}
+
+// NewSupervisor runs the operators made by create under policy. Panics of the operators are recovered
+// as *PanicError failures, only the panics of the goroutine running the operator though: operators
+// running callbacks in goroutines of their own, like mappers, recover them themselves.
+func NewSupervisor(create func() Operator, policy RestartPolicy) SupervisedOperator {
+	first := create()
+	s := &supervisor{NewHardStopChannelCloser(), create, policy, "Supervised " + Name(first), nil, nil,
+		sync.Mutex{}, first, false, 0, make([]error, 0)}
+	_, isIn := first.(In)
+	_, isOut := first.(Out)
+	if isIn {
+		s.in = NewBaseIn(CHAN_SLACK)
+	}
+	if isOut {
+		s.out = NewBaseOut(CHAN_SLACK)
+	}
+	switch {
+	case isIn && isOut:
+		return &inOutSupervisor{s, s.in, s.out}
+	case isIn:
+		return &inSupervisor{s, s.in}
+	case isOut:
+		return &outSupervisor{s, s.out}
+	}
+	return s
+}
+
+func (s *supervisor) String() string {
+	return s.name
+}
+
+func (s *supervisor) Restarts() int {
+	return int(atomic.LoadInt64(&s.restarts))
+}
+
+// Failures returns the errors of the failed operators, oldest first
+func (s *supervisor) Failures() []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]error(nil), s.failures...)
+}
+
+func (s *supervisor) Current() Operator {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current
+}
+
+func (s *supervisor) Pending() int {
+	n := pendingOf(s.Current())
+	if s.in != nil {
+		n += s.in.GetInDepth()
+	}
+	return n
+}
+
+// Stop stops the running operator; the stop channel is closed with the lock held so that replace doesn't
+// start another one
+func (s *supervisor) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopLocked()
+	return s.HardStopChannelCloser.Stop()
+}
+
+func (s *supervisor) stopCurrent() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopLocked()
+}
+
+func (s *supervisor) stopLocked() {
+	if !s.stopped {
+		s.stopped = true
+		s.current.Stop()
+	}
+}
+
+func (s *supervisor) Run() error {
+	return s.RunContext(context.Background())
+}
+
+func (s *supervisor) RunContext(ctx context.Context) error {
+	if s.out != nil {
+		defer close(s.out.Out())
+	}
+
+	restarts := make([]time.Time, 0)
+	backoff := s.policy.Backoff
+	for {
+		err := s.runCurrent(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-s.StopNotifier:
+			return nil
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		slog.Logf(logger.Levels.Error, "%s failed: %v", s.name, err)
+		s.lock.Lock()
+		s.failures = append(s.failures, err)
+		s.lock.Unlock()
+		if s.policy.Restart == RESTART_NEVER {
+			return err
+		}
+
+		now := time.Now()
+		recent := restarts[:0]
+		for _, t := range restarts {
+			if s.policy.Window <= 0 || now.Sub(t) < s.policy.Window {
+				recent = append(recent, t)
+			}
+		}
+		restarts = recent
+		if s.policy.MaxRestarts > 0 && len(restarts) >= s.policy.MaxRestarts {
+			return errors.Join(ErrTooManyRestarts, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.StopNotifier:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		backoff *= 2
+		if s.policy.MaxBackoff > 0 && backoff > s.policy.MaxBackoff {
+			backoff = s.policy.MaxBackoff
+		}
+
+		if !s.replace() {
+			return nil
+		}
+		restarts = append(restarts, time.Now())
+		atomic.AddInt64(&s.restarts, 1)
+		slog.Logf(logger.Levels.Warn, "Restarted %s", s.name)
+	}
+}
+
+// replace makes the next operator, unless the supervisor was stopped
+func (s *supervisor) replace() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.StopNotifier:
+		return false
+	default:
+	}
+	s.current = s.create()
+	s.stopped = false
+	return true
+}
+
+// runCurrent runs the current operator with the input of the supervisor, forwarding its output
+func (s *supervisor) runCurrent(ctx context.Context) error {
+	op := s.Current()
+	if s.in != nil {
+		op.(In).SetIn(s.in.In())
+	}
+	if s.out == nil {
+		return s.recovered(ctx, op)
+	}
+
+	ch := make(chan Object, CHAN_SLACK)
+	op.(Out).SetOut(ch)
+	exited := make(chan bool)
+	forwarded := make(chan bool)
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case obj, ok := <-ch:
+				if !ok {
+					return
+				}
+				s.forward(ctx, obj)
+			case <-exited:
+				//an operator that panicked may not have closed its output
+				for len(ch) > 0 {
+					s.forward(ctx, <-ch)
+				}
+				return
+			}
+		}
+	}()
+	err := s.recovered(ctx, op)
+	close(exited)
+	<-forwarded
+	return err
+}
+
+func (s *supervisor) forward(ctx context.Context, obj Object) {
+	select {
+	case s.out.Out() <- obj:
+	case <-s.StopNotifier:
+	case <-ctx.Done():
+	}
+}
+
+func (s *supervisor) recovered(ctx context.Context, op Operator) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewPanicError(Name(op), r)
+		}
+	}()
+	if cop, ok := op.(ContextOperator); ok {
+		return cop.RunContext(ctx)
+	}
+	defer context.AfterFunc(ctx, s.stopCurrent)()
+	return op.Run()
+}
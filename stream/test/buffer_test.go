@@ -0,0 +1,67 @@
+package stream
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/stream/source"
+	"github.com/cloudflare/go-stream/util"
+)
+
+func TestChainBuffers(t *testing.T) {
+	src := source.NewInterfaceReaderSource(util.NewInterfaceBuffer(1))
+	small := passthruOp("Small buffer")
+	big := passthruOp("Big buffer")
+
+	ch := stream.NewChain().SetBuffer(10)
+	ch.Add(src)
+	ch.AddWithBuffer(small, 1)
+	ch.AddWithBuffer(big, 1000)
+
+	fanout := stream.NewFanoutOp()
+	fanout.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)))
+	fanout.AddWithBuffer(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)), 5)
+	ch.Add(fanout)
+
+	if cap(src.Out()) != 10 || cap(small.Out()) != 1 || cap(big.Out()) != 1000 {
+		t.Error("Unexpected chain buffers ", cap(src.Out()), cap(small.Out()), cap(big.Out()))
+	}
+
+	branches := fanout.Branches()
+	if cap(branches[0].(stream.In).In()) != stream.CHAN_SLACK || cap(branches[1].(stream.In).In()) != 5 {
+		t.Error("Unexpected fanout buffers")
+	}
+
+	sub := ch.NewSubChain()
+	subOp := passthruOp("Sub chain")
+	sub.Add(subOp)
+	if cap(subOp.Out()) != 10 {
+		t.Error("Sub chain should inherit the buffer of its parent, got ", cap(subOp.Out()))
+	}
+}
+
+func TestNegativeBuffers(t *testing.T) {
+	src := source.NewInterfaceReaderSource(util.NewInterfaceBuffer(1))
+	op := passthruOp("Negative buffer")
+
+	ch := stream.NewChain().SetBuffer(-1)
+	ch.Add(src)
+	ch.AddWithBuffer(op, -5)
+
+	fanout := stream.NewFanoutOp().SetBuffer(-1)
+	fanout.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)))
+	fanout.AddWithBuffer(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)), -5)
+	ch.Add(fanout)
+
+	if cap(src.Out()) != stream.CHAN_SLACK || cap(op.Out()) != stream.CHAN_SLACK {
+		t.Error("Negative chain buffers should fall back to the default ", cap(src.Out()), cap(op.Out()))
+	}
+	for _, branch := range fanout.Branches() {
+		if cap(branch.(stream.In).In()) != stream.CHAN_SLACK {
+			t.Error("Negative fanout buffers should fall back to the default ", cap(branch.(stream.In).In()))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+)
+
+type failingOp struct {
+	*stream.HardStopChannelCloser
+	*stream.BaseIn
+	err error
+}
+
+func (op *failingOp) Run() error {
+	for {
+		select {
+		case _, ok := <-op.In():
+			if !ok {
+				return nil
+			}
+			return op.err
+		case <-op.StopNotifier:
+			return nil
+		}
+	}
+}
+
+func (op *failingOp) String() string {
+	return "failingOp"
+}
+
+func TestRunContextCancel(t *testing.T) {
+	input := make(chan stream.Object)
+
+	passthruFn := func(in int) []int {
+		return []int{in}
+	}
+
+	FirstOp := mapper.NewOp(passthruFn, "First PT ctx")
+	FirstOp.SetIn(input)
+
+	ch := stream.NewChain()
+	ch.Add(FirstOp)
+	ch.Add(mapper.NewOp(passthruFn, "2nd PT ctx"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- ch.RunContext(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("Expected deadline exceeded, got ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Chain did not exit after the context deadline")
+	}
+}
+
+func TestRunContextErrors(t *testing.T) {
+	input := make(chan stream.Object, 1)
+
+	passthruFn := func(in int) []int {
+		return []int{in}
+	}
+
+	FirstOp := mapper.NewOp(passthruFn, "First PT err")
+	FirstOp.SetIn(input)
+
+	failErr := errors.New("fail")
+	fanout := stream.NewFanoutOp()
+	fanout.Add(&failingOp{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), failErr})
+	fanout.Add(&failingOp{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), failErr})
+
+	ch := stream.NewChain()
+	ch.Add(FirstOp)
+	ch.Add(fanout)
+
+	input <- 1
+	err := ch.RunContext(context.Background())
+	if !errors.Is(err, failErr) {
+		t.Fatal("Expected the child error, got ", err)
+	}
+
+	var opErr *stream.OpError
+	if !errors.As(err, &opErr) || opErr.Op != stream.Name(fanout) {
+		t.Error("Expected error to be tagged with the fanout op, got ", err)
+	}
+	if len(ch.Errors()) != 1 {
+		t.Error("Expected 1 error from the chain, got ", ch.Errors())
+	}
+}
+
+func TestRunContextStopped(t *testing.T) {
+	op := &failingOp{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), errors.New("fail")}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- stream.RunContext(ctx, op)
+	}()
+	//the owner stops the op as the context is cancelled
+	op.Stop()
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	op.Stop()
+}
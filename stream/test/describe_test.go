@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/stream/source"
+	"github.com/cloudflare/go-stream/util"
+)
+
+func TestDescribe(t *testing.T) {
+	branch := stream.NewChain()
+	branch.Add(passthruOp("Branch PT"))
+	branch.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)))
+
+	fanout := stream.NewFanoutOp()
+	fanout.Add(stream.NewInChainWrapper(branch))
+	fanout.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)))
+
+	first := passthruOp("First PT")
+	ch := stream.NewChain().SetName("main")
+	ch.Add(source.NewInterfaceReaderSource(util.NewInterfaceBuffer(1)))
+	ch.Add(first)
+	ch.Add(fanout)
+
+	first.In() <- 1
+
+	g := stream.Describe(ch)
+	if len(g.Nodes) != 6 || len(g.Edges) != 5 {
+		t.Fatalf("Expected 6 nodes and 5 edges, got %d and %d", len(g.Nodes), len(g.Edges))
+	}
+	if g.Nodes[0].Kind != "source" || g.Nodes[2].Kind != "fanout" || g.Nodes[3].Chain != "main[2]/0" {
+		t.Error("Unexpected nodes ", g.Nodes[0], g.Nodes[2], g.Nodes[3])
+	}
+	if e := g.Edges[0]; e.From != 0 || e.To != 1 || e.Depth != 1 || e.Capacity != stream.CHAN_SLACK {
+		t.Error("Unexpected first edge ", e)
+	}
+
+	dot := g.DOT()
+	if !strings.Contains(dot, "n0 -> n1 [label=\"1/100\"]") || !strings.Contains(dot, "label=\"main[2]/0\"") {
+		t.Error("Unexpected DOT output ", dot)
+	}
+
+	js, err := g.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &stream.Graph{}
+	if err := json.Unmarshal(js, decoded); err != nil || len(decoded.Edges) != len(g.Edges) {
+		t.Error("Could not decode JSON output ", string(js), err)
+	}
+}
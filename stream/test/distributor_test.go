@@ -0,0 +1,208 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+)
+
+// countingSink counts its input and reports the count on done when its input closes
+type countingSink struct {
+	*stream.HardStopChannelCloser
+	*stream.BaseIn
+	done chan int
+}
+
+func (op *countingSink) Run() error {
+	n := 0
+	for {
+		select {
+		case _, ok := <-op.In():
+			if !ok {
+				op.done <- n
+				return nil
+			}
+			n++
+		case <-op.StopNotifier:
+			return nil
+		}
+	}
+}
+
+type eviction struct {
+	key    stream.DistribKey
+	reason stream.BranchEviction
+}
+
+func newTestDistributor(done chan int, created chan stream.DistribKey, evicted chan eviction) *stream.DistributeOperator {
+	dist := stream.NewDistributor(func(obj stream.Object) stream.DistribKey {
+		return obj
+	}, func(key stream.DistribKey) stream.DistributorChildOp {
+		return &countingSink{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), done}
+	})
+	return dist.SetHooks(func(key stream.DistribKey, _ stream.DistributorChildOp) {
+		created <- key
+	}, func(key stream.DistribKey, _ stream.DistributorChildOp, reason stream.BranchEviction) {
+		evicted <- eviction{key, reason}
+	})
+}
+
+func TestDistributorMaxBranches(t *testing.T) {
+	done := make(chan int, 10)
+	created := make(chan stream.DistribKey, 10)
+	evicted := make(chan eviction, 10)
+	dist := newTestDistributor(done, created, evicted).SetMaxBranches(2)
+
+	exit := make(chan error)
+	go func() {
+		exit <- dist.Run()
+	}()
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		dist.In() <- key
+	}
+	if ev := <-evicted; ev.key != "b" || ev.reason != stream.EVICT_LRU {
+		t.Error("Expected the least recently used branch to be evicted, got ", ev)
+	}
+	if n := <-done; n != 1 {
+		t.Error("Evicted branch should flush its input, got ", n)
+	}
+	if len(dist.Branches()) != 2 {
+		t.Error("Expected 2 open branches, got ", len(dist.Branches()))
+	}
+
+	close(dist.In())
+	if err := <-exit; err != nil {
+		t.Fatal("Eviction should not be reported as an unexpected child close, got ", err)
+	}
+	if len(created) != 3 {
+		t.Error("Expected 3 branches to be created, got ", len(created))
+	}
+}
+
+func TestDistributorIdleTimeout(t *testing.T) {
+	done := make(chan int, 10)
+	created := make(chan stream.DistribKey, 10)
+	evicted := make(chan eviction, 10)
+	dist := newTestDistributor(done, created, evicted).SetIdleTimeout(20 * time.Millisecond)
+
+	exit := make(chan error)
+	go func() {
+		exit <- dist.Run()
+	}()
+
+	dist.In() <- "a"
+	dist.In() <- "a"
+	select {
+	case ev := <-evicted:
+		if ev.key != "a" || ev.reason != stream.EVICT_IDLE {
+			t.Error("Unexpected eviction ", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle branch was not evicted")
+	}
+	if n := <-done; n != 2 {
+		t.Error("Evicted branch should flush its input, got ", n)
+	}
+
+	dist.In() <- "a"
+	close(dist.In())
+	if err := <-exit; err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 {
+		t.Error("Expected the branch to be re-created, got ", len(created))
+	}
+}
+
+// valueSink is not comparable, the runner can't retire it
+type valueSink struct {
+	*countingSink
+	tags []string
+}
+
+func TestDistributorNotEvictable(t *testing.T) {
+	dist := stream.NewDistributor(func(obj stream.Object) stream.DistribKey {
+		return obj
+	}, func(key stream.DistribKey) stream.DistributorChildOp {
+		return valueSink{&countingSink{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), make(chan int, 1)}, nil}
+	}).SetMaxBranches(1)
+
+	exit := make(chan error)
+	go func() {
+		exit <- dist.Run()
+	}()
+	dist.In() <- "a"
+	select {
+	case err := <-exit:
+		if err == nil {
+			t.Error("A branch that can't be evicted should fail the distributor")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Distributor did not fail")
+	}
+}
+
+// slowSink sends its input on seen, delaying the objects in slow
+type slowSink struct {
+	*stream.HardStopChannelCloser
+	*stream.BaseIn
+	seen chan string
+	slow map[string]bool
+}
+
+func (op *slowSink) Run() error {
+	for {
+		select {
+		case obj, ok := <-op.In():
+			if !ok {
+				return nil
+			}
+			if op.slow[obj.(string)] {
+				time.Sleep(100 * time.Millisecond)
+			}
+			op.seen <- obj.(string)
+		case <-op.StopNotifier:
+			return nil
+		}
+	}
+}
+
+func TestDistributorEvictedOrder(t *testing.T) {
+	seen := make(chan string, 10)
+	dist := stream.NewDistributor(func(obj stream.Object) stream.DistribKey {
+		return obj.(string)[:1]
+	}, func(key stream.DistribKey) stream.DistributorChildOp {
+		return &slowSink{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), seen, map[string]bool{"a1": true}}
+	}).SetMaxBranches(1)
+
+	exit := make(chan error)
+	go func() {
+		exit <- dist.Run()
+	}()
+
+	//a1 is still flushing in its evicted branch when a2 comes
+	for _, obj := range []string{"a1", "b1", "a2"} {
+		dist.In() <- obj
+	}
+	order := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		order = append(order, <-seen)
+	}
+	for _, obj := range order {
+		if obj == "a2" {
+			t.Fatal("Objects of a key out of order across evicted branches ", order)
+		}
+		if obj == "a1" {
+			break
+		}
+	}
+
+	close(dist.In())
+	if err := <-exit; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+)
+
+type stuckSink struct {
+	*stream.HardStopChannelCloser
+	*stream.BaseIn
+}
+
+func (op *stuckSink) Run() error {
+	<-op.StopNotifier
+	return nil
+}
+
+func (op *stuckSink) String() string {
+	return "stuckSink"
+}
+
+func TestDrain(t *testing.T) {
+	input := make(chan stream.Object, 10)
+
+	passthruFn := func(in int) []int {
+		return []int{in}
+	}
+
+	FirstOp := mapper.NewOp(passthruFn, "First PT drain")
+	FirstOp.SetIn(input)
+	batcher := stream.NewInterfaceBatchOp(stream.NewNonBlockingProcessedNotifier(2))
+	batcher.MaxOutstanding = 0
+	batcher.SetTimeouts(time.Hour)
+	output := make(chan stream.Object, 10)
+	collector := mapper.NewOp(func(in stream.Object, out mapper.Outputer) {
+		output <- in
+	}, "Collector drain")
+
+	ch := stream.NewChain()
+	ch.Add(FirstOp)
+	ch.Add(batcher)
+	ch.Add(collector)
+	ch.Start()
+
+	for i := 0; i < 5; i++ {
+		input <- i
+	}
+	for batcher.Pending() != 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	dropped, err := ch.Drain(5 * time.Second)
+	if err != nil || len(dropped) != 0 {
+		t.Fatal("Expected a clean drain, got ", dropped, err)
+	}
+	if batch := (<-output).([]interface{}); len(batch) != 5 {
+		t.Error("Batcher did not flush on drain, got ", batch)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	input := make(chan stream.Object, 10)
+
+	passthruFn := func(in int) []int {
+		return []int{in}
+	}
+
+	FirstOp := mapper.NewOp(passthruFn, "First PT drain timeout")
+	FirstOp.SetIn(input)
+	sink := &stuckSink{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK)}
+
+	ch := stream.NewChain()
+	ch.Add(FirstOp)
+	ch.Add(sink)
+	ch.Start()
+
+	for i := 0; i < 5; i++ {
+		input <- i
+	}
+	for sink.GetInDepth() != 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	dropped, err := ch.Drain(50 * time.Millisecond)
+	if !errors.Is(err, stream.ErrDrainTimeout) {
+		t.Fatal("Expected drain timeout, got ", err)
+	}
+	if len(dropped) != 1 || dropped[0].Op != "stuckSink" || dropped[0].Count != 5 {
+		t.Error("Wrong dropped report ", dropped)
+	}
+}
+
+func TestDrainTimeoutInFlight(t *testing.T) {
+	input := make(chan stream.Object, 10)
+	block := make(chan bool)
+	started := make(chan bool, 10)
+
+	blockingFn := func(in int) []int {
+		started <- true
+		<-block
+		return []int{in}
+	}
+
+	FirstOp := mapper.NewOp(blockingFn, "Blocking drain")
+	FirstOp.SetWorkers(1)
+	FirstOp.SetIn(input)
+	sink := mapper.NewOp(func(in stream.Object, out mapper.Outputer) {}, "Sink drain")
+
+	ch := stream.NewChain()
+	ch.Add(FirstOp)
+	ch.Add(sink)
+	ch.Start()
+
+	for i := 0; i < 3; i++ {
+		input <- i
+	}
+	<-started
+	time.AfterFunc(200*time.Millisecond, func() { close(block) })
+
+	dropped, err := ch.Drain(50 * time.Millisecond)
+	if !errors.Is(err, stream.ErrDrainTimeout) {
+		t.Fatal("Expected drain timeout, got ", err)
+	}
+	if len(dropped) != 1 || dropped[0].Op != "Blocking drain" || dropped[0].Count != 3 {
+		t.Error("Wrong dropped report ", dropped)
+	}
+}
@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+	"github.com/cloudflare/go-stream/util"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var errOdd = errors.New("Odd")
+
+// runFailing maps 0 to 9 through an op failing on odd numbers, the first failures times of each
+func runFailing(policy mapper.ErrorPolicy, failures int, deadLetter stream.InChain) ([]int, error, util.MetricsGroup) {
+	var lock sync.Mutex
+	attempts := make(map[int]int)
+	op := mapper.NewOpErr(func(obj stream.Object, out mapper.Outputer) error {
+		i := obj.(int)
+		lock.Lock()
+		attempts[i]++
+		n := attempts[i]
+		lock.Unlock()
+		ch := out.Out(2)
+		ch <- i
+		if i%2 == 1 && n <= failures {
+			return errOdd
+		}
+		ch <- i
+		return nil
+	}, "Failing").SetErrorPolicy(policy)
+	if deadLetter != nil {
+		op.SetDeadLetter(deadLetter)
+	}
+	group := util.NewStreamingMetrics(metrics.NewRegistry()).Register("Failing")
+	op.SetMetrics(&group)
+
+	input := make(chan stream.Object, 10)
+	for i := 0; i < 10; i++ {
+		input <- i
+	}
+	close(input)
+	output := make(chan stream.Object, 20)
+	ordered := op.MakeOrdered().(*mapper.OrderPreservingOp)
+	ordered.SetIn(input)
+	ordered.SetOut(output)
+
+	err := ordered.Run()
+	res := make([]int, 0)
+	for obj := range output {
+		res = append(res, obj.(int))
+	}
+	return res, err, group
+}
+
+func TestErrorPolicies(t *testing.T) {
+	res, err, group := runFailing(mapper.ErrorPolicy{Action: mapper.ERROR_SKIP}, 1, nil)
+	if err != nil || len(res) != 10 || group.Errors.Count() != 5 {
+		t.Error("Skip: got ", res, err, group.Errors.Count())
+	}
+
+	res, err, group = runFailing(mapper.ErrorPolicy{Action: mapper.ERROR_FAIL, Retries: 2, Backoff: time.Millisecond}, 2, nil)
+	if err != nil || len(res) != 20 || group.Retries.Count() != 10 || group.Errors.Count() != 0 {
+		t.Error("Retry: got ", res, err, group.Retries.Count(), group.Errors.Count())
+	}
+	for i, v := range res {
+		if v != i/2 {
+			t.Fatal("Retry: out of order ", res)
+		}
+	}
+
+	_, err, group = runFailing(mapper.ErrorPolicy{Action: mapper.ERROR_FAIL}, 1, nil)
+	//the error failing the op is counted by the runner, not run here
+	if !errors.Is(err, errOdd) || group.Errors.Count() != 0 {
+		t.Error("Fail: got ", err, group.Errors.Count())
+	}
+
+	var dead []*mapper.DeadLetter
+	collect := mapper.NewOp(func(obj stream.Object, _ mapper.Outputer) {
+		dead = append(dead, obj.(*mapper.DeadLetter))
+	}, "DeadLetters").SetParallel(false)
+	deadLetter := stream.NewInChainWrapper(stream.NewChain().Add(collect))
+	res, err, group = runFailing(mapper.ErrorPolicy{Action: mapper.ERROR_DEAD_LETTER, Retries: 1}, 5, deadLetter)
+	if err != nil || len(res) != 10 || len(dead) != 5 || group.DeadLetters.Count() != 5 || group.Retries.Count() != 5 {
+		t.Fatal("Dead letter: got ", res, err, len(dead), group.DeadLetters.Count())
+	}
+	for _, d := range dead {
+		if d.Item.(int)%2 != 1 || d.Err != errOdd {
+			t.Error("Wrong dead letter ", d)
+		}
+	}
+}
+
+func TestMapperPanic(t *testing.T) {
+	op := mapper.NewOrderedOp(func(obj stream.Object, out mapper.Outputer) {
+		ch := out.Out(2)
+		ch <- obj
+		if obj.(int) == 5 {
+			panic("five")
+		}
+		ch <- obj
+	}, "Panicky")
+	input := make(chan stream.Object, 100)
+	for i := 0; i < 100; i++ {
+		input <- i
+	}
+	close(input)
+	op.SetIn(input)
+	op.SetOut(make(chan stream.Object, 200))
+
+	var panicErr *stream.PanicError
+	if err := op.Run(); !errors.As(err, &panicErr) || panicErr.Value != "five" {
+		t.Error("Expected the panic as error, got ", err)
+	}
+}
@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+)
+
+// gatedSink does not read its input until gate is closed, then collects it
+type gatedSink struct {
+	*stream.HardStopChannelCloser
+	*stream.BaseIn
+	gate chan bool
+	got  []stream.Object
+}
+
+func newGatedSink() *gatedSink {
+	return &gatedSink{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), make(chan bool), nil}
+}
+
+func (op *gatedSink) Run() error {
+	select {
+	case <-op.gate:
+	case <-op.StopNotifier:
+		return nil
+	}
+	for {
+		select {
+		case obj, ok := <-op.In():
+			if !ok {
+				return nil
+			}
+			op.got = append(op.got, obj)
+		case <-op.StopNotifier:
+			return nil
+		}
+	}
+}
+
+func runFanout(t *testing.T, fanout *stream.FanoutOperator, n int, slow *gatedSink) {
+	done := make(chan error)
+	go func() {
+		done <- fanout.Run()
+	}()
+	for i := 0; i < n; i++ {
+		fanout.In() <- []byte(fmt.Sprint(i))
+	}
+	close(fanout.In())
+	for fanout.GetInDepth() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(slow.gate)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fanout did not exit")
+	}
+}
+
+func TestFanoutPolicies(t *testing.T) {
+	const n = 50
+	policies := []struct {
+		policy  *stream.BranchPolicy
+		dropped int
+		first   string
+	}{
+		{&stream.BranchPolicy{Policy: stream.FANOUT_DROP_NEWEST}, n - 2, "0"},
+		{&stream.BranchPolicy{Policy: stream.FANOUT_DROP_OLDEST}, n - 2, fmt.Sprint(n - 2)},
+		{&stream.BranchPolicy{Policy: stream.FANOUT_DETACH, Timeout: time.Millisecond}, n - 2, "0"},
+		{&stream.BranchPolicy{Policy: stream.FANOUT_SPILL, SpillDir: t.TempDir()}, 0, "0"},
+	}
+
+	for _, p := range policies {
+		fast := newGatedSink()
+		close(fast.gate)
+		slow := newGatedSink()
+
+		fanout := stream.NewFanoutOp()
+		fanout.Add(fast)
+		fanout.AddBranch(slow, 2, p.policy)
+		runFanout(t, fanout, n, slow)
+
+		if len(fast.got) != n {
+			t.Errorf("Policy %d: slow branch throttled the fast one, got %d objects", p.policy.Policy, len(fast.got))
+		}
+		dropped := fanout.Dropped()
+		if dropped[0].Count != 0 || dropped[1].Count != p.dropped || len(slow.got) != n-p.dropped {
+			t.Errorf("Policy %d: unexpected drops %v, slow branch got %d objects", p.policy.Policy, dropped, len(slow.got))
+			continue
+		}
+		if string(slow.got[0].([]byte)) != p.first {
+			t.Errorf("Policy %d: expected %s first, got %s", p.policy.Policy, p.first, slow.got[0])
+		}
+		if p.policy.Policy == stream.FANOUT_SPILL {
+			for i, obj := range slow.got {
+				if string(obj.([]byte)) != fmt.Sprint(i) {
+					t.Fatal("Spilled objects out of order at ", i)
+				}
+			}
+		}
+	}
+}
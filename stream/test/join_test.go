@@ -0,0 +1,72 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/util"
+)
+
+type keyed struct {
+	key string
+	sec int
+}
+
+var keyedSide = stream.JoinSide{
+	Key: func(obj stream.Object) interface{} {
+		return obj.(keyed).key
+	},
+	Time: func(obj stream.Object) time.Time {
+		return time.Unix(int64(obj.(keyed).sec), 0)
+	},
+}
+
+func runJoin(t *testing.T, typ stream.JoinType) *util.InterfaceBuffer {
+	join := stream.NewJoinOp(keyedSide, keyedSide, 5*time.Second, typ, func(left stream.Object, right stream.Object) stream.Object {
+		if right == nil {
+			return left.(keyed).key + "-"
+		}
+		return left.(keyed).key + "+" + right.(keyed).key
+	})
+
+	output := util.NewInterfaceBuffer(10)
+	ch := stream.NewOrderedChain()
+	ch.Add(join)
+	ch.Add(sink.NewInterfaceWriterSink(output))
+	ch.Start()
+
+	//the right objects are read before the left ones
+	join.Right() <- keyed{"a", 1}
+	join.Right() <- keyed{"b", 2}
+	for len(join.Right()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, obj := range []keyed{{"a", 3}, {"b", 20}, {"d", 21}} {
+		join.In() <- obj
+	}
+	close(join.In())
+	if err := ch.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func TestJoin(t *testing.T) {
+	inner := runJoin(t, stream.INNER_JOIN)
+	if inner.Len() != 1 || inner.Get(0) != "a+a" {
+		t.Error("Expected only a to match within the window, got ", inner)
+	}
+
+	outer := runJoin(t, stream.LEFT_OUTER_JOIN)
+	got := make(map[interface{}]bool)
+	for i := 0; i < outer.Len(); i++ {
+		got[outer.Get(i)] = true
+	}
+	if outer.Len() != 3 || !got["a+a"] || !got["b-"] || !got["d-"] {
+		t.Error("Expected unmatched left objects with a nil right, got ", outer)
+	}
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/stream/source"
+	"github.com/cloudflare/go-stream/util"
+)
+
+func bufferOf(objs ...interface{}) *util.InterfaceBuffer {
+	buf := util.NewInterfaceBuffer(len(objs))
+	for _, obj := range objs {
+		buf.Write(obj)
+	}
+	return buf
+}
+
+func TestMerge(t *testing.T) {
+	upstream := stream.NewChain()
+	upstream.Add(source.NewInterfaceReaderSource(bufferOf(1, 2, 3)))
+	upstream.Add(passthruOp("Merge upstream PT"))
+
+	merge := stream.NewMergeOp()
+	merge.Add(source.NewInterfaceReaderSource(bufferOf(4, 5)))
+	merge.Add(stream.NewOutChainWrapper(upstream))
+
+	output := util.NewInterfaceBuffer(5)
+	ch := stream.NewChain()
+	ch.Add(merge)
+	ch.Add(sink.NewInterfaceWriterSink(output))
+	if err := ch.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := 0
+	for i := 0; i < output.Len(); i++ {
+		sum += output.Get(i).(int)
+	}
+	if output.Len() != 5 || sum != 15 {
+		t.Error("Expected every object of both inputs, got ", output.Len(), sum)
+	}
+}
+
+func TestMergeOrdered(t *testing.T) {
+	merge := stream.NewMergeOp().SetOrderKey(func(obj stream.Object) int64 {
+		return int64(obj.(int))
+	})
+	merge.Add(source.NewInterfaceReaderSource(bufferOf(1, 4, 7)))
+	merge.Add(source.NewInterfaceReaderSource(bufferOf(2, 3, 8, 9)))
+	merge.Add(source.NewInterfaceReaderSource(bufferOf()))
+
+	output := util.NewInterfaceBuffer(7)
+	ch := stream.NewChain()
+	ch.Add(merge)
+	ch.Add(sink.NewInterfaceWriterSink(output))
+	if err := ch.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.Len() != 7 {
+		t.Fatal("Expected 7 objects, got ", output.Len())
+	}
+	for i := 1; i < output.Len(); i++ {
+		if output.Get(i-1).(int) > output.Get(i).(int) {
+			t.Fatal("Merge is not ordered at ", i)
+		}
+	}
+	if g := stream.Describe(ch); len(g.Nodes) != 5 || len(g.Edges) != 4 {
+		t.Error("Expected the merge inputs in the graph, got ", len(g.Nodes), len(g.Edges))
+	}
+}
+
+// idleSource produces nothing until stopped
+type idleSource struct {
+	*stream.HardStopChannelCloser
+	*stream.BaseOut
+}
+
+func (op *idleSource) Run() error {
+	defer close(op.Out())
+	<-op.StopNotifier
+	return nil
+}
+
+func TestMergeStopIdle(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		merge := stream.NewMergeOp()
+		if ordered {
+			merge.SetOrderKey(func(obj stream.Object) int64 {
+				return int64(obj.(int))
+			})
+		}
+		merge.Add(&idleSource{stream.NewHardStopChannelCloser(), stream.NewBaseOut(stream.CHAN_SLACK)})
+		merge.Add(&idleSource{stream.NewHardStopChannelCloser(), stream.NewBaseOut(stream.CHAN_SLACK)})
+		merge.SetOut(make(chan stream.Object, 1))
+
+		exit := make(chan error)
+		go func() {
+			exit <- merge.Run()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		merge.Stop()
+		select {
+		case err := <-exit:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Merge of idle inputs did not stop, ordered: ", ordered)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/util"
+	"github.com/cloudflare/go-stream/util/slog"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestRunnerMetrics(t *testing.T) {
+	oldGm := slog.Gm
+	slog.Gm = util.NewStreamingMetrics(metrics.NewRegistry())
+	defer func() {
+		slog.Gm = oldGm
+	}()
+
+	input := make(chan stream.Object, 10)
+	FirstOp := mapper.NewOp(func(in int) []int {
+		return []int{in, in}
+	}, "Metrics PT")
+	FirstOp.SetIn(input)
+
+	ch := stream.NewChain()
+	ch.Add(FirstOp)
+	ch.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(20)))
+	ch.Start()
+	for i := 0; i < 10; i++ {
+		input <- i
+	}
+	close(input)
+	ch.Wait()
+
+	groups := slog.Gm.Groups()
+	mapGroup, ok := groups["Metrics PT"]
+	if !ok {
+		t.Fatal("Mapper op was not registered")
+	}
+	if mapGroup.In.Count() != 10 || mapGroup.Out.Count() != 20 || mapGroup.Latency.Count() != 10 {
+		t.Error("Wrong mapper metrics in ", mapGroup.In.Count(), " out ", mapGroup.Out.Count(), " latency ", mapGroup.Latency.Count())
+	}
+
+	input = make(chan stream.Object, 1)
+	SecondOp := passthruOp("Metrics PT fail")
+	SecondOp.SetIn(input)
+	ch = stream.NewChain()
+	ch.Add(SecondOp)
+	ch.Add(&failingOp{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), errors.New("fail")})
+	ch.Start()
+	input <- 1
+	ch.Wait()
+
+	if failGroup, ok := slog.Gm.Groups()["failingOp"]; !ok || failGroup.Errors.Count() != 1 {
+		t.Error("Error of failingOp not counted")
+	}
+
+	//a mapper failing on an item or panicking is counted once
+	for _, name := range []string{"Metrics mapper fail", "Metrics mapper panic"} {
+		input = make(chan stream.Object, 1)
+		op := mapper.NewOpErr(func(obj stream.Object, out mapper.Outputer) error {
+			if name == "Metrics mapper panic" {
+				panic("fail")
+			}
+			return errors.New("fail")
+		}, name).SetErrorPolicy(mapper.ErrorPolicy{Action: mapper.ERROR_FAIL})
+		op.SetIn(input)
+		ch = stream.NewChain()
+		ch.Add(op)
+		ch.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)))
+		ch.Start()
+		input <- 1
+		ch.Wait()
+		if group, ok := slog.Gm.Groups()[name]; !ok || group.Errors.Count() != 1 {
+			t.Error("Error of ", name, " should be counted once")
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+)
+
+func TestStrategyDistributor(t *testing.T) {
+	done := make(chan int, 10)
+	creator := func(key stream.DistribKey) stream.DistributorChildOp {
+		return &countingSink{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), done}
+	}
+	strategy, err := stream.NewRoundRobinStrategy(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dist := stream.NewStrategyDistributor(strategy, creator)
+
+	exit := make(chan error)
+	go func() {
+		exit <- dist.Run()
+	}()
+	for i := 0; i < 6; i++ {
+		dist.In() <- i
+	}
+	close(dist.In())
+	if err := <-exit; err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	branches := 0
+	for n := range done {
+		branches++
+		if n != 2 {
+			t.Error("Expected 2 objects per branch, got ", n)
+		}
+	}
+	if branches != 3 {
+		t.Error("Expected 3 pre-created branches, got ", branches)
+	}
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	key := func(obj stream.Object) string {
+		return obj.(string)
+	}
+	four, err := stream.NewConsistentHashStrategy(4, 64, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	five, err := stream.NewConsistentHashStrategy(5, 64, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := stream.NewHashStrategy(4, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprint("key", i)
+		if hash.Pick(k, nil) != hash.Pick(k, nil) {
+			t.Fatal("Hash strategy is not stable")
+		}
+		before, after := four.Pick(k, nil), five.Pick(k, nil)
+		if before != after {
+			moved++
+			if after != 4 {
+				t.Fatalf("Key %s moved from %d to %d instead of the new branch", k, before, after)
+			}
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Error("Expected about a fifth of the keys to move, moved ", moved)
+	}
+}
+
+func TestLeastDepthStrategy(t *testing.T) {
+	depths := []int{3, 1, 2}
+	s, err := stream.NewLeastDepthStrategy(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := s.Pick(nil, func(b int) int { return depths[b] }); b != 1 {
+		t.Error("Expected the least loaded branch, got ", b)
+	}
+}
+
+func TestStrategyArguments(t *testing.T) {
+	key := func(obj stream.Object) string {
+		return fmt.Sprint(obj)
+	}
+	for name, create := range map[string]func() (stream.DistributionStrategy, error){
+		"hash":            func() (stream.DistributionStrategy, error) { return stream.NewHashStrategy(0, key) },
+		"consistent hash": func() (stream.DistributionStrategy, error) { return stream.NewConsistentHashStrategy(-1, 10, key) },
+		"vnodes":          func() (stream.DistributionStrategy, error) { return stream.NewConsistentHashStrategy(3, 0, key) },
+		"round robin":     func() (stream.DistributionStrategy, error) { return stream.NewRoundRobinStrategy(0) },
+		"least depth":     func() (stream.DistributionStrategy, error) { return stream.NewLeastDepthStrategy(0) },
+	} {
+		var strategyErr *stream.StrategyError
+		if s, err := create(); s != nil || !errors.As(err, &strategyErr) {
+			t.Error(name, " strategy should refuse its arguments, got ", err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/stream/source"
+	"github.com/cloudflare/go-stream/util"
+)
+
+// panickingOp panics in Run on its first object
+type panickingOp struct {
+	*stream.HardStopChannelCloser
+	*stream.BaseIn
+}
+
+func (op *panickingOp) Run() error {
+	select {
+	case <-op.In():
+		panic("boom")
+	case <-op.StopNotifier:
+		return nil
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	var panicked int64
+	create := func() stream.Operator {
+		return mapper.NewOp(func(obj stream.Object, out mapper.Outputer) {
+			if obj.(int) == 3 && atomic.CompareAndSwapInt64(&panicked, 0, 1) {
+				panic("three")
+			}
+			out.Out(1) <- obj
+		}, "Panicky").SetParallel(false)
+	}
+	sup := stream.NewSupervisor(create, stream.RestartPolicy{Restart: stream.RESTART_ON_FAILURE, Backoff: time.Millisecond})
+
+	output := util.NewInterfaceBuffer(10)
+	ch := stream.NewChain()
+	ch.Add(source.NewInterfaceReaderSource(bufferOf(0, 1, 2, 3, 4, 5, 6, 7, 8, 9)))
+	ch.Add(sup)
+	ch.Add(sink.NewInterfaceWriterSink(output))
+	if err := ch.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.Len() != 9 || sup.Restarts() != 1 {
+		t.Error("Expected all but the object that panicked after 1 restart, got ", output.Len(), sup.Restarts())
+	}
+	var panicErr *stream.PanicError
+	if failures := sup.Failures(); len(failures) != 1 || !errors.As(failures[0], &panicErr) || panicErr.Value != "three" {
+		t.Error("Expected the panic as failure, got ", failures)
+	}
+}
+
+func TestSupervisorPolicies(t *testing.T) {
+	create := func() stream.Operator {
+		return &panickingOp{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK)}
+	}
+
+	never := stream.NewSupervisor(create, stream.RestartPolicy{Restart: stream.RESTART_NEVER})
+	never.(stream.In).In() <- 1
+	var panicErr *stream.PanicError
+	if err := never.Run(); !errors.As(err, &panicErr) || len(panicErr.Stack) == 0 || never.Restarts() != 0 {
+		t.Error("Expected the panic with its stack, got ", err)
+	}
+
+	//without a window, MaxRestarts caps the restarts in total
+	for _, window := range []time.Duration{time.Minute, 0} {
+		limited := stream.NewSupervisor(create, stream.RestartPolicy{Restart: stream.RESTART_ON_FAILURE,
+			Backoff: time.Millisecond, MaxRestarts: 2, Window: window})
+		for i := 0; i < 5; i++ {
+			limited.(stream.In).In() <- i
+		}
+		if err := limited.Run(); !errors.Is(err, stream.ErrTooManyRestarts) || limited.Restarts() != 2 {
+			t.Error("Expected to give up after 2 restarts, got ", err, limited.Restarts(), window)
+		}
+	}
+}
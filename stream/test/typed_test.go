@@ -0,0 +1,125 @@
+package stream
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+)
+
+func collectInto[T any](out chan T) *stream.TypedSink[T] {
+	op := mapper.NewOp(func(in stream.Object, _ mapper.Outputer) {
+		out <- in.(T)
+	}, "Collect")
+	return stream.AsSink[T](op)
+}
+
+func TestTypedChain(t *testing.T) {
+	input := make(chan stream.Object, 10)
+	src := mapper.NewOp(func(in stream.Object, out mapper.Outputer) {
+		out.Out(1) <- in
+	}, "Typed src")
+	src.SetIn(input)
+
+	itoa := mapper.MapOrdered(strconv.Itoa, "Itoa")
+	length := mapper.Map(func(s string) int { return len(s) }, "Len")
+
+	strs := make(chan string, 10)
+	lens := make(chan int, 10)
+	fanout := stream.NewTypedFanout(
+		collectInto(strs),
+		stream.NewTypedBranch(length).To(collectInto(lens)),
+	)
+
+	typed := stream.Then(stream.NewTypedChainFrom(stream.NewOrderedChain(), stream.AsSource[int](src)), itoa)
+	ch := typed.To(fanout)
+	ch.Start()
+
+	input <- 7
+	input <- 42
+	for _, expected := range []string{"7", "42"} {
+		if s := <-strs; s != expected {
+			t.Error("Got ", s, " Expected ", expected)
+		}
+	}
+	if l1, l2 := <-lens, <-lens; l1+l2 != 3 {
+		t.Error("Wrong lengths ", l1, l2)
+	}
+	ch.Stop()
+	ch.Wait()
+}
+
+func TestTypedChecked(t *testing.T) {
+	input := make(chan stream.Object, 10)
+	src := mapper.NewOp(func(in stream.Object, out mapper.Outputer) {
+		out.Out(1) <- in
+	}, "Untyped src")
+	src.SetIn(input)
+
+	strs := make(chan string, 10)
+	typed := stream.Then(stream.NewTypedChain(stream.AsSource[stream.Object](src)), stream.Checked[string]())
+	ch := typed.To(collectInto(strs))
+	ch.Start()
+
+	input <- "ok"
+	if s := <-strs; s != "ok" {
+		t.Error("Got ", s)
+	}
+	input <- 1
+	var mismatch *stream.TypeMismatchError
+	if err := ch.Wait(); !errors.As(err, &mismatch) {
+		t.Error("Expected a type mismatch, got ", err)
+	}
+}
+
+func TestMapperHelpers(t *testing.T) {
+	input := make(chan stream.Object, 10)
+	src := mapper.NewOp(func(in stream.Object, out mapper.Outputer) {
+		out.Out(1) <- in
+	}, "Helpers src")
+	src.SetIn(input)
+
+	var tapped int64
+	even := mapper.Filter(func(i int) bool { return i%2 == 0 }, "Even")
+	twice := mapper.FlatMap(func(i int) []int {
+		if i%4 == 0 {
+			return nil
+		}
+		return []int{i, i}
+	}, "Twice")
+	tap := mapper.Tap(func(int) { atomic.AddInt64(&tapped, 1) }, "Tap")
+	byMod := mapper.KeyBy(func(i int) int { return i % 3 }, "Mod")
+
+	results := make(chan mapper.Keyed[int, int], 1000)
+	typed := stream.NewTypedChainFrom(stream.NewOrderedChain(), stream.AsSource[int](src))
+	ch := stream.Then(stream.Then(stream.Then(stream.Then(typed, even), twice), tap), byMod).To(collectInto(results))
+	ch.Start()
+
+	for i := 0; i < 400; i++ {
+		input <- i
+	}
+	close(input)
+	if err := ch.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	close(results)
+
+	expected := 2
+	n := 0
+	for r := range results {
+		if r.Value != expected || r.Key != expected%3 {
+			t.Fatal("Got ", r, " Expected ", expected)
+		}
+		if n++; n%2 == 0 {
+			expected += 4
+		}
+	}
+	if n != 200 || atomic.LoadInt64(&tapped) != 200 {
+		t.Error("Got ", n, " results and ", tapped, " tapped, expected 200")
+	}
+}
@@ -0,0 +1,85 @@
+package stream
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/stream/source"
+	"github.com/cloudflare/go-stream/util"
+)
+
+func passthruOp(name string) *mapper.Op {
+	return mapper.NewOp(func(in int) []int {
+		return []int{in}
+	}, name)
+}
+
+func TestValidateMiswired(t *testing.T) {
+	ch := stream.NewChain()
+	ch.Add(source.NewInterfaceReaderSource(util.NewInterfaceBuffer(1)))
+	ch.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)))
+	ch.Add(passthruOp("After sink"))
+
+	var topoErr *stream.TopologyError
+	if err := ch.Start(); !errors.As(err, &topoErr) || topoErr.Index != 2 {
+		t.Fatal("Expected a topology error on the 3rd operator, got ", err)
+	}
+	if err := ch.Wait(); err == nil {
+		t.Error("Wait should return the start error")
+	}
+}
+
+func TestValidateBranches(t *testing.T) {
+	buf := util.NewInterfaceBuffer(1)
+	buf.Write(1)
+
+	good := stream.NewChain()
+	good.Add(passthruOp("Branch PT"))
+	good.Add(sink.NewInterfaceWriterSink(util.NewInterfaceBuffer(1)))
+
+	noSink := stream.NewChain()
+	noSink.Add(passthruOp("Branch no sink"))
+
+	fanout := stream.NewFanoutOp()
+	fanout.Add(stream.NewInChainWrapper(good))
+	fanout.Add(stream.NewInChainWrapper(noSink))
+
+	ch := stream.NewChain().SetName("main")
+	ch.Add(source.NewInterfaceReaderSource(buf))
+	ch.Add(fanout)
+
+	err := ch.(*stream.SimpleChain).Validate()
+	if err == nil || !strings.Contains(err.Error(), "main[1]/1[0]") || strings.Contains(err.Error(), "main[1]/0") {
+		t.Fatal("Expected only the branch without a sink to be reported, got ", err)
+	}
+	if err := ch.Run(); err != nil {
+		t.Error("Wiring is valid, chain should run: ", err)
+	}
+}
+
+// unorderableOp can't be made ordered
+type unorderableOp struct {
+	*mapper.Op
+}
+
+func (op *unorderableOp) MakeOrdered() stream.ParallelizableOperator {
+	return op
+}
+
+func TestValidateUnordered(t *testing.T) {
+	ch := stream.NewOrderedChain()
+	ch.SetName("ordered")
+	ch.Add(source.NewInterfaceReaderSource(util.NewInterfaceBuffer(1)))
+	ch.Add(&unorderableOp{passthruOp("Unorderable")})
+
+	var topoErr *stream.TopologyError
+	if err := ch.Start(); !errors.As(err, &topoErr) || topoErr.Index != 1 || topoErr.Op != "Unorderable" {
+		t.Fatal("Expected a topology error on the unorderable op, got ", err)
+	}
+}
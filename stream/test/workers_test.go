@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/mapper"
+)
+
+func TestWorkers(t *testing.T) {
+	var active, peak int64
+	release := make(chan bool)
+	op := mapper.NewOp(func(in stream.Object, out mapper.Outputer) {
+		n := atomic.AddInt64(&active, 1)
+		for p := atomic.LoadInt64(&peak); n > p && !atomic.CompareAndSwapInt64(&peak, p, n); p = atomic.LoadInt64(&peak) {
+		}
+		<-release
+		atomic.AddInt64(&active, -1)
+		out.Out(1) <- in
+	}, "Blocking").SetWorkers(3)
+	input := make(chan stream.Object, 10)
+	op.SetIn(input)
+	op.SetOut(make(chan stream.Object, 10))
+
+	done := make(chan error)
+	go func() { done <- op.Run() }()
+	for i := 0; i < 6; i++ {
+		input <- i
+	}
+	time.Sleep(50 * time.Millisecond)
+	if op.Workers() != 3 || atomic.LoadInt64(&peak) != 3 {
+		t.Error("Expected 3 workers, got ", op.Workers(), " running ", peak, " at once")
+	}
+	close(release)
+	close(input)
+	<-done
+	if op.Workers() != 0 {
+		t.Error("Workers left running ", op.Workers())
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	op := mapper.NewOp(func(in stream.Object, out mapper.Outputer) {
+		time.Sleep(2 * time.Millisecond)
+		out.Out(1) <- in
+	}, "Slow")
+	op.SetAutoscale(1, 4, 5*time.Millisecond)
+	ordered := op.MakeOrdered().(*mapper.OrderPreservingOp)
+
+	input := make(chan stream.Object, 500)
+	output := make(chan stream.Object, 500)
+	ordered.SetIn(input)
+	ordered.SetOut(output)
+	done := make(chan error)
+	go func() { done <- ordered.Run() }()
+
+	for i := 0; i < 300; i++ {
+		input <- i
+	}
+	peak := 0
+	for i := 0; i < 300; i++ {
+		if obj := <-output; obj.(int) != i {
+			t.Fatal("Got ", obj, " Expected ", i)
+		}
+		if w := ordered.Workers(); w > peak {
+			peak = w
+		}
+	}
+	if peak < 2 || peak > 4 {
+		t.Error("Expected to scale up to at most 4 workers, peaked at ", peak)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for ordered.Workers() > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ordered.Workers() != 1 {
+		t.Error("Expected to scale down to 1 worker, got ", ordered.Workers())
+	}
+	close(input)
+	<-done
+}
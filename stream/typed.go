@@ -0,0 +1,188 @@
+package stream
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/* The typed layer wraps untyped operators with the types of the objects they consume and produce, so that
+   the compiler checks stage boundaries when a chain is assembled. Objects still travel as Object on the channels. */
+
+type outOperator interface {
+	Operator
+	Out
+}
+
+type inOperator interface {
+	Operator
+	In
+}
+
+// TypedSource is an operator producing objects of type T
+type TypedSource[T any] struct {
+	op outOperator
+}
+
+// TypedOp is an operator consuming objects of type In and producing objects of type Out
+type TypedOp[In, Out any] struct {
+	op InOutOperator
+}
+
+// TypedSink is an operator consuming objects of type T
+type TypedSink[T any] struct {
+	op inOperator
+}
+
+// AsSource declares that the untyped op produces objects of type T. Use Checked after it if that is not guaranteed.
+func AsSource[T any](op interface {
+	Operator
+	Out
+}) *TypedSource[T] {
+	return &TypedSource[T]{op}
+}
+
+// AsOp declares that the untyped op consumes objects of type In and produces objects of type Out
+func AsOp[In, Out any](op InOutOperator) *TypedOp[In, Out] {
+	return &TypedOp[In, Out]{op}
+}
+
+// AsSink declares that the untyped op consumes objects of type T
+func AsSink[T any](op interface {
+	Operator
+	In
+}) *TypedSink[T] {
+	return &TypedSink[T]{op}
+}
+
+func (s *TypedSource[T]) Operator() Operator {
+	return s.op
+}
+
+func (o *TypedOp[In, Out]) Operator() Operator {
+	return o.op
+}
+
+func (s *TypedSink[T]) Operator() Operator {
+	return s.op
+}
+
+// TypedChain is a chain starting at a source whose last operator produces objects of type T
+type TypedChain[T any] struct {
+	chain Chain
+}
+
+func NewTypedChain[T any](src *TypedSource[T]) *TypedChain[T] {
+	return NewTypedChainFrom(NewChain(), src)
+}
+
+// NewTypedChainFrom adds src to the empty chain c, e.g. an OrderedChain
+func NewTypedChainFrom[T any](c Chain, src *TypedSource[T]) *TypedChain[T] {
+	c.Add(src.op)
+	return &TypedChain[T]{c}
+}
+
+// Then appends op to c. It is a function since methods can't introduce type parameters.
+func Then[In, Out any](c *TypedChain[In], op *TypedOp[In, Out]) *TypedChain[Out] {
+	c.chain.Add(op.op)
+	return &TypedChain[Out]{c.chain}
+}
+
+// To terminates c with sink and returns the untyped chain, ready to be started
+func (c *TypedChain[T]) To(sink *TypedSink[T]) Chain {
+	c.chain.Add(sink.op)
+	return c.chain
+}
+
+// Chain returns the untyped chain, to add untyped operators with Add
+func (c *TypedChain[T]) Chain() Chain {
+	return c.chain
+}
+
+// TypedBranch is a chain without a source consuming objects of type In, whose last operator produces
+// objects of type T. Once terminated with To it can be used as a fanout or distributor branch.
+type TypedBranch[In, T any] struct {
+	chain Chain
+}
+
+func NewTypedBranch[In, T any](first *TypedOp[In, T]) *TypedBranch[In, T] {
+	return NewTypedBranchFrom(NewChain(), first)
+}
+
+// NewTypedBranchFrom adds first to the empty chain c, e.g. one created by NewSubChain
+func NewTypedBranchFrom[In, T any](c Chain, first *TypedOp[In, T]) *TypedBranch[In, T] {
+	c.Add(first.op)
+	return &TypedBranch[In, T]{c}
+}
+
+func BranchThen[In, Mid, Out any](b *TypedBranch[In, Mid], op *TypedOp[Mid, Out]) *TypedBranch[In, Out] {
+	b.chain.Add(op.op)
+	return &TypedBranch[In, Out]{b.chain}
+}
+
+// To terminates the branch with sink, turning the whole branch into a sink of In
+func (b *TypedBranch[In, T]) To(sink *TypedSink[T]) *TypedSink[In] {
+	b.chain.Add(sink.op)
+	return &TypedSink[In]{NewInChainWrapper(b.chain)}
+}
+
+// NewTypedFanout copies every object of type T to all the branches
+func NewTypedFanout[T any](branches ...*TypedSink[T]) *TypedSink[T] {
+	fanout := NewFanoutOp()
+	for _, b := range branches {
+		fanout.Add(b.op)
+	}
+	return &TypedSink[T]{fanout}
+}
+
+// NewTypedDistributor sends each object of type T to the branch of its key, creating branches on demand
+func NewTypedDistributor[T any, K comparable](key func(T) K, creator func(K) *TypedSink[T]) *TypedSink[T] {
+	mapp := func(obj Object) DistribKey {
+		return key(obj.(T))
+	}
+	create := func(k DistribKey) DistributorChildOp {
+		return creator(k.(K)).op
+	}
+	return &TypedSink[T]{NewDistributor(mapp, create)}
+}
+
+// TypeMismatchError is returned by a Checked operator when an object is not of the expected type
+type TypeMismatchError struct {
+	Expected reflect.Type
+	Got      reflect.Type
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("Expected object of type %v but got %v", e.Expected, e.Got)
+}
+
+type checkedOp[T any] struct {
+	*BaseInOutOp
+}
+
+// Checked is the adapter from untyped operators: it verifies each object is a T and fails
+// with a *TypeMismatchError, instead of letting a later type assertion panic.
+func Checked[T any]() *TypedOp[Object, T] {
+	return &TypedOp[Object, T]{&checkedOp[T]{NewBaseInOutOp(CHAN_SLACK)}}
+}
+
+func (op *checkedOp[T]) String() string {
+	return "Checked[" + reflect.TypeOf((*T)(nil)).Elem().String() + "]"
+}
+
+func (op *checkedOp[T]) Run() error {
+	defer close(op.Out())
+	for {
+		select {
+		case obj, ok := <-op.In():
+			if !ok {
+				return nil
+			}
+			if _, ok := obj.(T); !ok {
+				return &TypeMismatchError{reflect.TypeOf((*T)(nil)).Elem(), reflect.TypeOf(obj)}
+			}
+			op.Out() <- obj
+		case <-op.StopNotifier:
+			return nil
+		}
+	}
+}
@@ -1,16 +1,23 @@
 package stream
 
+import "sync"
+
 type HardStopChannelCloser struct {
 	StopNotifier chan bool
+	once         sync.Once
 }
 
+// Stop closes StopNotifier. Calls after the first are no-ops, so that the owner of an operator and
+// RunContext can both stop it.
 func (op *HardStopChannelCloser) Stop() error {
-	close(op.StopNotifier)
+	op.once.Do(func() {
+		close(op.StopNotifier)
+	})
 	return nil
 }
 
 func NewHardStopChannelCloser() *HardStopChannelCloser {
-	return &HardStopChannelCloser{make(chan bool)}
+	return &HardStopChannelCloser{StopNotifier: make(chan bool)}
 }
 
 type BaseIn struct {
@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TopologyError describes an operator that can't be wired where it was added
+type TopologyError struct {
+	Path  string // the chain, and the branches leading to it
+	Index int    // position of the operator in the chain, -1 for the chain itself
+	Op    string
+	Msg   string
+}
+
+func (e *TopologyError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+	}
+	return fmt.Sprintf("%s[%d] %s: %s", e.Path, e.Index, e.Op, e.Msg)
+}
+
+// BranchHolder is implemented by operators that feed other operators or chains, like fanouts and distributors
+type BranchHolder interface {
+	Branches() []Operator
+}
+
+type operatorLister interface {
+	Operators() []Operator
+}
+
+// Validate checks the chain is a complete pipeline: every operator consumes what the previous one produces,
+// it starts with a source and ends with a sink, and so do the branches of its fanouts and distributors
+// (except that branches are fed by their parent instead of a source).
+// Start only runs the wiring checks, since chains fed or drained by hand are valid.
+func (c *SimpleChain) Validate() error {
+	return errors.Join(validateOps(c.path(), c.Operators(), false, true), c.orderErrors())
+}
+
+func (c *SimpleChain) orderErrors() error {
+	ops := c.Operators()
+	errs := make([]error, 0, len(c.unordered))
+	for _, i := range c.unordered {
+		errs = append(errs, &TopologyError{c.path(), i, Name(ops[i]), "could not be made ordered in an ordered chain"})
+	}
+	return errors.Join(errs...)
+}
+
+func (c *SimpleChain) path() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return "chain"
+}
+
+func branchOps(branch Operator) []Operator {
+	if lister, ok := branch.(operatorLister); ok {
+		return lister.Operators()
+	}
+	return []Operator{branch}
+}
+
+func validateBranch(path string, branch Operator, complete bool) error {
+	return validateOps(path, branchOps(branch), true, complete)
+}
+
+// validateOps checks a list of operators wired one after the other. A fed list gets its input from a parent
+// operator; complete also requires a source (unless fed) and a sink.
+func validateOps(path string, ops []Operator, fed bool, complete bool) error {
+	if len(ops) == 0 {
+		return &TopologyError{path, -1, "", "has no operators"}
+	}
+
+	errs := make([]error, 0)
+	for i, op := range ops {
+		_, isIn := op.(In)
+		_, isOut := op.(Out)
+		if i == 0 {
+			if fed && !isIn {
+				errs = append(errs, &TopologyError{path, i, Name(op), "is a branch but does not take input"})
+			}
+			if !fed && complete && isIn {
+				errs = append(errs, &TopologyError{path, i, Name(op), "takes input but the chain has no source"})
+			}
+		} else {
+			if !isIn {
+				errs = append(errs, &TopologyError{path, i, Name(op), "does not take input, a source can only start a chain"})
+			}
+			if _, ok := ops[i-1].(Out); !ok {
+				errs = append(errs, &TopologyError{path, i, Name(op), fmt.Sprintf("follows %s which has no output", Name(ops[i-1]))})
+			}
+		}
+		if i == len(ops)-1 && complete && isOut {
+			errs = append(errs, &TopologyError{path, i, Name(op), "has an output that is never consumed, the chain has no sink"})
+		}
+
+		if holder, ok := op.(BranchHolder); ok {
+			for j, branch := range holder.Branches() {
+				errs = append(errs, validateBranch(fmt.Sprintf("%s[%d]/%d", path, i, j), branch, complete))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
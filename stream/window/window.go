@@ -0,0 +1,330 @@
+package window
+
+import (
+	"fmt"
+	"github.com/cloudflare/go-stream/stream"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/* Windowing groups objects by event time into windows and reduces each window to a result once the watermark
+   passes its end. The Windower is a stream.BatchContainer: the BatcherOperator decides when to flush, and each
+   flush emits a []*Result of the windows that closed since the previous one.
+
+   The watermark is the largest event time seen minus the max out of orderness. Windows stay open for the allowed
+   lateness after they fire: objects arriving in that time re-emit the window as an update, later ones are dropped. */
+
+type Span struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Assigner returns the windows an event time belongs to
+type Assigner interface {
+	Assign(t time.Time) []Span
+	// Merging assigners (sessions) merge the overlapping windows of a key
+	Merging() bool
+}
+
+type Result struct {
+	Key    interface{}
+	Start  time.Time
+	End    time.Time
+	Value  stream.Object
+	Update bool //the window was already emitted, this result includes late objects
+}
+
+type tumbling struct {
+	size time.Duration
+}
+
+// AssignerError is a window size, slide or gap an assigner can't use
+type AssignerError struct {
+	Msg string
+}
+
+func (e *AssignerError) Error() string {
+	return e.Msg
+}
+
+// TumblingWindows are consecutive windows of size, aligned on the Unix epoch. size must be positive.
+func TumblingWindows(size time.Duration) (Assigner, error) {
+	if size <= 0 {
+		return nil, &AssignerError{fmt.Sprintf("Tumbling windows need a positive size, got %v", size)}
+	}
+	return &tumbling{size}, nil
+}
+
+// epochStart is the start of the window of size containing t, the windows being aligned on the Unix epoch.
+// time.Truncate aligns on the zero time instead, which is off for sizes like 7m or a week.
+func epochStart(t time.Time, size time.Duration) time.Time {
+	offset := time.Duration(t.UnixNano() % int64(size))
+	if offset < 0 {
+		offset += size
+	}
+	return t.Add(-offset)
+}
+
+func (a *tumbling) Assign(t time.Time) []Span {
+	start := epochStart(t, a.size)
+	return []Span{{start, start.Add(a.size)}}
+}
+
+func (a *tumbling) Merging() bool {
+	return false
+}
+
+type sliding struct {
+	size  time.Duration
+	slide time.Duration
+}
+
+// SlidingWindows are windows of size starting every slide, aligned on the Unix epoch, so that each event time
+// is in size/slide windows.
+// It needs 0 < slide <= size: a larger slide would leave gaps between the windows.
+func SlidingWindows(size time.Duration, slide time.Duration) (Assigner, error) {
+	if slide <= 0 || slide > size {
+		return nil, &AssignerError{fmt.Sprintf("Sliding windows need 0 < slide <= size, got a slide of %v and a size of %v", slide, size)}
+	}
+	return &sliding{size, slide}, nil
+}
+
+func (a *sliding) Assign(t time.Time) []Span {
+	spans := make([]Span, 0, int(a.size/a.slide))
+	for start := epochStart(t, a.slide); start.Add(a.size).After(t); start = start.Add(-a.slide) {
+		spans = append(spans, Span{start, start.Add(a.size)})
+	}
+	return spans
+}
+
+func (a *sliding) Merging() bool {
+	return false
+}
+
+type session struct {
+	gap time.Duration
+}
+
+// SessionWindows group the objects of a key until no object comes for gap. gap must be positive.
+func SessionWindows(gap time.Duration) (Assigner, error) {
+	if gap <= 0 {
+		return nil, &AssignerError{fmt.Sprintf("Session windows need a positive gap, got %v", gap)}
+	}
+	return &session{gap}, nil
+}
+
+func (a *session) Assign(t time.Time) []Span {
+	return []Span{{t, t.Add(a.gap)}}
+}
+
+func (a *session) Merging() bool {
+	return true
+}
+
+type window struct {
+	Span
+	items []stream.Object
+	fired bool //emitted, kept open for the allowed lateness
+	dirty bool //objects were added since the window was emitted
+}
+
+type Windower struct {
+	assigner      Assigner
+	eventTime     func(stream.Object) time.Time
+	reduce        func(key interface{}, objs []stream.Object) stream.Object
+	key           func(stream.Object) interface{}
+	maxOutOfOrder time.Duration
+	lateness      time.Duration
+	windows       map[interface{}][]*window
+	maxEventTime  time.Time
+	watermark     int64 //UnixNano, atomic
+	droppedLate   int64 //atomic
+	dirty         int
+}
+
+// NewWindower reduces the objects of each window with reduce, which is called again with all the objects
+// of the window if late objects update it
+func NewWindower(assigner Assigner, eventTime func(stream.Object) time.Time, reduce func(key interface{}, objs []stream.Object) stream.Object) *Windower {
+	return &Windower{assigner, eventTime, reduce, nil, 0, 0, make(map[interface{}][]*window), time.Time{}, 0, 0, 0}
+}
+
+// SetKey windows the objects of each key separately. Without a key all objects share the nil key.
+func (w *Windower) SetKey(key func(stream.Object) interface{}) *Windower {
+	w.key = key
+	return w
+}
+
+// SetMaxOutOfOrder sets how far behind the latest event time the watermark is
+func (w *Windower) SetMaxOutOfOrder(d time.Duration) *Windower {
+	w.maxOutOfOrder = d
+	return w
+}
+
+// SetAllowedLateness keeps windows open for d after the watermark passed their end
+func (w *Windower) SetAllowedLateness(d time.Duration) *Windower {
+	w.lateness = d
+	return w
+}
+
+func (w *Windower) Watermark() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&w.watermark))
+}
+
+// DroppedLate is the number of objects that arrived after their windows were closed for good
+func (w *Windower) DroppedLate() int {
+	return int(atomic.LoadInt64(&w.droppedLate))
+}
+
+func (w *Windower) closed(s Span, watermark time.Time) bool {
+	return !s.End.Add(w.lateness).After(watermark)
+}
+
+func (w *Windower) Add(obj stream.Object) {
+	t := w.eventTime(obj)
+	if t.After(w.maxEventTime) {
+		w.maxEventTime = t
+		atomic.StoreInt64(&w.watermark, t.Add(-w.maxOutOfOrder).UnixNano())
+	}
+	watermark := w.Watermark()
+
+	var key interface{}
+	if w.key != nil {
+		key = w.key(obj)
+	}
+
+	spans := w.assigner.Assign(t)
+	added := false
+	for _, span := range spans {
+		if w.closed(span, watermark) {
+			continue
+		}
+		added = true
+		if w.assigner.Merging() {
+			w.merge(key, span, obj)
+		} else {
+			w.insert(key, span, obj)
+		}
+	}
+	if !added && len(spans) > 0 {
+		atomic.AddInt64(&w.droppedLate, 1)
+	}
+}
+
+func (w *Windower) markDirty(win *window) {
+	if !win.dirty {
+		win.dirty = true
+		w.dirty++
+	}
+}
+
+func (w *Windower) insert(key interface{}, span Span, obj stream.Object) {
+	for _, win := range w.windows[key] {
+		if win.Span == span {
+			win.items = append(win.items, obj)
+			w.markDirty(win)
+			return
+		}
+	}
+	win := &window{span, []stream.Object{obj}, false, false}
+	w.markDirty(win)
+	w.windows[key] = append(w.windows[key], win)
+}
+
+// merge adds a window for obj and merges it with all the windows of key it overlaps, transitively
+func (w *Windower) merge(key interface{}, span Span, obj stream.Object) {
+	merged := &window{span, []stream.Object{obj}, false, false}
+	w.markDirty(merged)
+	windows := w.windows[key]
+	for changed := true; changed; {
+		changed = false
+		rest := windows[:0]
+		for _, win := range windows {
+			if win.Start.After(merged.End) || merged.Start.After(win.End) {
+				rest = append(rest, win)
+				continue
+			}
+			changed = true
+			if win.Start.Before(merged.Start) {
+				merged.Start = win.Start
+			}
+			if win.End.After(merged.End) {
+				merged.End = win.End
+			}
+			merged.items = append(win.items, merged.items...)
+			merged.fired = merged.fired || win.fired
+			if win.dirty {
+				w.dirty--
+			}
+		}
+		windows = rest
+	}
+	w.windows[key] = append(windows, merged)
+}
+
+// results reduces the dirty windows ending before the watermark (all of them if all is set)
+// and forgets the windows closed for good
+func (w *Windower) results(all bool) []*Result {
+	watermark := w.Watermark()
+	results := make([]*Result, 0)
+	for key, windows := range w.windows {
+		open := windows[:0]
+		for _, win := range windows {
+			if win.dirty && (all || !win.End.After(watermark)) {
+				results = append(results, &Result{key, win.Start, win.End, w.reduce(key, win.items), win.fired})
+				win.fired = true
+				win.dirty = false
+				w.dirty--
+			}
+			if !all && !w.closed(win.Span, watermark) {
+				open = append(open, win)
+			}
+		}
+		if len(open) == 0 {
+			delete(w.windows, key)
+		} else {
+			w.windows[key] = open
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].End.Before(results[j].End)
+	})
+	return results
+}
+
+func (w *Windower) Flush(out chan<- stream.Object) bool {
+	results := w.results(false)
+	if len(results) == 0 {
+		return false
+	}
+	out <- results
+	return true
+}
+
+func (w *Windower) FlushAll(out chan<- stream.Object) bool {
+	results := w.results(true)
+	if len(results) == 0 {
+		return false
+	}
+	out <- results
+	return true
+}
+
+// HasItems is true while some window has objects it has not emitted
+func (w *Windower) HasItems() bool {
+	return w.dirty > 0
+}
+
+// NewWindowOp runs w in a BatcherOperator flushing every flushInterval. With a nil pn, flushes don't wait
+// for downstream.
+func NewWindowOp(w *Windower, flushInterval time.Duration, pn stream.ProcessedNotifier) *stream.BatcherOperator {
+	outstanding := uint(1)
+	if pn == nil {
+		pn = stream.NewNonBlockingProcessedNotifier(1)
+		outstanding = 0
+	}
+	op := stream.NewBatchOperator("WindowOp", w, pn)
+	op.MaxOutstanding = outstanding
+	op.SetTimeouts(flushInterval)
+	return op
+}
@@ -0,0 +1,180 @@
+package window
+
+import (
+	"errors"
+	"github.com/cloudflare/go-stream/stream"
+	"testing"
+	"time"
+)
+
+type event struct {
+	key string
+	t   time.Time
+}
+
+func at(sec int) time.Time {
+	return time.Unix(int64(sec), 0)
+}
+
+func count(key interface{}, objs []stream.Object) stream.Object {
+	return len(objs)
+}
+
+// mustAssign fails the test on an assigner error
+func mustAssign(t *testing.T) func(Assigner, error) Assigner {
+	return func(a Assigner, err error) Assigner {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+}
+
+func newTestWindower(a Assigner) *Windower {
+	return NewWindower(a, func(obj stream.Object) time.Time {
+		return obj.(event).t
+	}, count).SetKey(func(obj stream.Object) interface{} {
+		return obj.(event).key
+	})
+}
+
+func flush(w *Windower, all bool) []*Result {
+	out := make(chan stream.Object, 1)
+	var ok bool
+	if all {
+		ok = w.FlushAll(out)
+	} else {
+		ok = w.Flush(out)
+	}
+	if !ok {
+		return nil
+	}
+	return (<-out).([]*Result)
+}
+
+func TestTumblingWatermark(t *testing.T) {
+	w := newTestWindower(mustAssign(t)(TumblingWindows(10 * time.Second))).SetMaxOutOfOrder(2 * time.Second).SetAllowedLateness(5 * time.Second)
+
+	w.Add(event{"a", at(1)})
+	w.Add(event{"a", at(9)})
+	w.Add(event{"a", at(11)})
+	if r := flush(w, false); r != nil {
+		t.Fatal("Watermark at 9s should not close [0, 10), got ", r)
+	}
+
+	w.Add(event{"a", at(12)})
+	r := flush(w, false)
+	if len(r) != 1 || r[0].Value != 2 || !r[0].Start.Equal(at(0)) || r[0].Update {
+		t.Fatal("Expected [0, 10) with 2 objects, got ", r)
+	}
+
+	w.Add(event{"a", at(5)})
+	if r := flush(w, false); len(r) != 1 || r[0].Value != 3 || !r[0].Update {
+		t.Fatal("Expected an update of [0, 10) with the late object, got ", r)
+	}
+
+	w.Add(event{"a", at(20)})
+	w.Add(event{"a", at(3)})
+	if w.DroppedLate() != 1 {
+		t.Error("Object after the allowed lateness should be dropped, dropped ", w.DroppedLate())
+	}
+
+	r = flush(w, true)
+	if len(r) != 2 || r[0].Value != 2 || r[1].Value != 1 || w.HasItems() {
+		t.Error("FlushAll should emit the open windows, got ", r)
+	}
+}
+
+func TestSlidingWindows(t *testing.T) {
+	w := newTestWindower(mustAssign(t)(SlidingWindows(10*time.Second, 5*time.Second)))
+	w.Add(event{"a", at(7)})
+	w.Add(event{"b", at(12)})
+
+	r := flush(w, true)
+	if len(r) != 4 {
+		t.Fatal("Expected each object in 2 windows, got ", len(r))
+	}
+	if !r[0].Start.Equal(at(0)) || r[0].Key != "a" || !r[3].End.Equal(at(20)) || r[3].Key != "b" {
+		t.Error("Unexpected windows ", r[0], r[3])
+	}
+}
+
+func TestEpochAlignment(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	must := mustAssign(t)
+	for _, test := range []struct {
+		assigner Assigner
+		t        time.Time
+		start    time.Time
+	}{
+		{must(TumblingWindows(7 * time.Minute)), at(420*1000 + 5), at(420 * 1000)},
+		{must(TumblingWindows(week)), at(int(week/time.Second) + 3600), at(int(week / time.Second))},
+		{must(TumblingWindows(10 * time.Second)), at(-1), at(-10)},
+		{must(SlidingWindows(14*time.Minute, 7*time.Minute)), at(420*1000 + 5), at(420 * 999)},
+	} {
+		spans := test.assigner.Assign(test.t)
+		if !spans[len(spans)-1].Start.Equal(test.start) {
+			t.Errorf("Expected %v to be in a window starting at %v, got %v", test.t.Unix(), test.start.Unix(), spans[len(spans)-1].Start.Unix())
+		}
+	}
+}
+
+func TestAssignerArguments(t *testing.T) {
+	for name, create := range map[string]func() (Assigner, error){
+		"zero tumbling":   func() (Assigner, error) { return TumblingWindows(0) },
+		"zero slide":      func() (Assigner, error) { return SlidingWindows(time.Second, 0) },
+		"negative slide":  func() (Assigner, error) { return SlidingWindows(time.Second, -time.Second) },
+		"slide over size": func() (Assigner, error) { return SlidingWindows(time.Second, 2*time.Second) },
+		"zero gap":        func() (Assigner, error) { return SessionWindows(0) },
+	} {
+		var assignerErr *AssignerError
+		if a, err := create(); a != nil || !errors.As(err, &assignerErr) {
+			t.Error(name, " windows should be refused, got ", err)
+		}
+	}
+	if spans := mustAssign(t)(SlidingWindows(time.Second, time.Second)).Assign(at(3)); len(spans) != 1 {
+		t.Error("A slide equal to the size is tumbling, got ", spans)
+	}
+}
+
+func TestSessionWindows(t *testing.T) {
+	w := newTestWindower(mustAssign(t)(SessionWindows(5 * time.Second))).SetMaxOutOfOrder(time.Minute)
+	w.Add(event{"a", at(0)})
+	w.Add(event{"a", at(12)})
+	w.Add(event{"a", at(3)})
+	w.Add(event{"b", at(4)})
+	w.Add(event{"a", at(8)}) //bridges [0, 8) and [12, 17)
+
+	r := flush(w, true)
+	if len(r) != 2 {
+		t.Fatal("Expected one session per key, got ", len(r))
+	}
+	for _, res := range r {
+		if res.Key == "a" && (res.Value != 4 || !res.Start.Equal(at(0)) || !res.End.Equal(at(17))) {
+			t.Error("Unexpected session ", res)
+		}
+	}
+}
+
+func TestWindowOp(t *testing.T) {
+	w := newTestWindower(mustAssign(t)(TumblingWindows(time.Second)))
+	op := NewWindowOp(w, time.Millisecond, nil)
+	done := make(chan error)
+	go func() {
+		done <- op.Run()
+	}()
+	for i := 0; i < 10; i++ {
+		op.In() <- event{"a", time.Unix(0, int64(i)*int64(200*time.Millisecond))}
+	}
+	close(op.In())
+
+	total := 0
+	for obj := range op.Out() {
+		for _, r := range obj.([]*Result) {
+			total += r.Value.(int)
+		}
+	}
+	if err := <-done; err != nil || total != 10 {
+		t.Error("Expected all 10 objects in windows, got ", total, err)
+	}
+}
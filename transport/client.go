@@ -1,10 +1,12 @@
 package transport
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/cloudflare/golog/logger"
 	"net"
+	"reflect"
 	"github.com/cloudflare/go-stream/stream"
 	"github.com/cloudflare/go-stream/stream/sink"
 	"github.com/cloudflare/go-stream/stream/source"
@@ -17,16 +19,27 @@ import (
 const ACK_TIMEOUT_MS = 10000
 const RETRY_MAX = 100
 
+// ErrRetriesExceeded is returned by Run after RETRY_MAX failed connections, the unacked batches are still buffered
+var ErrRetriesExceeded = errors.New("Connection retries exceeded")
+
 type Client struct {
 	*stream.HardStopChannelCloser
 	*stream.BaseIn
 	addr string
 	//id string
-	hwm      int
-	buf      util.SequentialBuffer
-	retries  int
-	running  bool
-	notifier stream.ProcessedNotifier
+	hwm       int
+	buf       util.SequentialBuffer
+	retries   int
+	running   bool
+	notifier  stream.ProcessedNotifier
+	tlsConfig *tls.Config
+	session   SessionId
+	clientId     string
+	encodings    []string
+	compressions []string
+	pending      []byte //read from the input, the buffer failed to add it
+	minVersion   int
+	version      int
 }
 
 func DefaultClient(ip string) *Client {
@@ -35,7 +48,79 @@ func DefaultClient(ip string) *Client {
 
 func NewClient(addr string, hwm int) *Client {
 	buf := util.NewSequentialBufferChanImpl(hwm + 1)
-	return &Client{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), addr, hwm, buf, 0, false, nil}
+	return &Client{stream.NewHardStopChannelCloser(), stream.NewBaseIn(stream.CHAN_SLACK), addr, hwm, buf, 0, false, nil, nil, NewSessionId(),
+		defaultClientId(), nil, []string{COMPRESSION_NONE}, nil, PROTOCOL_V1, PROTOCOL_VERSION}
+}
+
+// SetBuffer replaces the in-memory buffer of the batches not acked yet, by a *Spool to keep them on disk.
+// The batches already in buf are sent first when connecting. The client takes the session of a
+// SessionBuffer, since the sequence numbers of its batches belong to it.
+func (src *Client) SetBuffer(buf util.SequentialBuffer) *Client {
+	src.buf = buf
+	if sb, ok := buf.(SessionBuffer); ok {
+		src.session = sb.Session()
+	}
+	return src
+}
+
+// SetClientId names the client in its hello, it is the host name by default
+func (src *Client) SetClientId(id string) *Client {
+	src.clientId = id
+	return src
+}
+
+// SetEncodings lists the encodings of the batches, by preference, for the server to check it can read them
+func (src *Client) SetEncodings(encodings ...string) *Client {
+	src.encodings = encodings
+	return src
+}
+
+// SetCompressions lists the compressions the client offers, by preference. The server picks one, or none,
+// and decompresses the batches before sending them downstream. Batches are not compressed by default.
+func (src *Client) SetCompressions(compressions ...string) *Client {
+	src.compressions = supported(compressions)
+	return src
+}
+
+// SetProtocolVersions sets the versions the client speaks, PROTOCOL_V1 to PROTOCOL_VERSION by default.
+// Servers predating the handshake close the connection on a hello, or exit; clients of those servers must
+// be set to a max of PROTOCOL_V0, which sends no hello. A min of PROTOCOL_V0 lets servers downgrade the
+// client to it. Either way the batches are not compressed and the server does not drop the ones it got
+// before a reconnect.
+func (src *Client) SetProtocolVersions(min int, max int) *Client {
+	src.minVersion = min
+	src.version = max
+	return src
+}
+
+func (src *Client) hello() *Hello {
+	return &Hello{src.version, src.minVersion, src.clientId, src.session, src.compressions, src.encodings}
+}
+
+// checkWelcome refuses the choices of a server that the client did not offer
+func (src *Client) checkWelcome(w *Welcome) error {
+	if w.Version < src.minVersion || w.Version > src.version {
+		return &ProtocolError{fmt.Sprintf("Server chose protocol %d, client speaks %d-%d", w.Version, src.minVersion, src.version), nil}
+	}
+	if w.Compression != COMPRESSION_NONE && (w.Version == PROTOCOL_V0 || preferred([]string{w.Compression}, src.compressions) == "") {
+		return &ProtocolError{fmt.Sprintf("Server chose compression %s, client offered %v", w.Compression, src.compressions), nil}
+	}
+	if w.Encoding != "" && preferred([]string{w.Encoding}, src.encodings) == "" {
+		return &ProtocolError{fmt.Sprintf("Server chose encoding %s, client offered %v", w.Encoding, src.encodings), nil}
+	}
+	return nil
+}
+
+// Session identifies the batches of the client to the servers, which drop the ones they already received
+func (src *Client) Session() SessionId {
+	return src.session
+}
+
+// SetTLSConfig makes the client connect over TLS. Set Certificates in config for servers requiring a client
+// certificate.
+func (src *Client) SetTLSConfig(config *tls.Config) *Client {
+	src.tlsConfig = config
+	return src
 }
 
 func (src *Client) SetNotifier(n stream.ProcessedNotifier) *Client {
@@ -46,17 +131,21 @@ func (src *Client) SetNotifier(n stream.ProcessedNotifier) *Client {
 	return src
 }
 
-func (src *Client) processAck(seq int) (progress bool) {
+// processAck drops the acked batches. An ack of a batch that was not sent is a *ProtocolError.
+func (src *Client) processAck(seq int) (progress bool, err error) {
 	//log.Println("Processing ack", seq)
-	cnt := src.buf.Ack(seq)
+	cnt, err := src.buf.Ack(seq)
+	if err != nil {
+		return false, &ProtocolError{fmt.Sprintf("Ack %d", seq), err}
+	}
 	if cnt > 0 {
 		if src.notifier != nil {
 			src.notifier.Notify(cnt)
 		}
 		src.retries = 0
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 func (c *Client) ReConnect() error {
@@ -73,26 +162,94 @@ func (src *Client) Run() error {
 		src.running = false
 	}()
 
+	//the queue depth is polled by the stream.Runner running this op
 	slog.Gm.Register(stream.Name(src))
-	go func(op string, s *Client) { // Update the queue depth on input for each phase
-		for {
-			slog.Gm.Update(&op, s.GetInDepth())
-			time.Sleep(1 * time.Second)
-		}
-	}(stream.Name(src), src)
 
 	for src.retries < RETRY_MAX {
 		err := src.connect()
+		var rejected *RejectedError
+		var mismatch *stream.TypeMismatchError
 		if err == nil {
 			slog.Logf(logger.Levels.Warn, "Connection failed without error")
 			return err
+		} else if errors.As(err, &rejected) || errors.As(err, &mismatch) {
+			slog.Logf(logger.Levels.Error, "Connection failed, not retrying: %s", err)
+			return err
 		} else {
 			slog.Logf(logger.Levels.Error, "Connection failed with error, retrying: %s", err)
-			time.Sleep(1 * time.Second)
+			if ok, err := src.waitRetry(); err != nil {
+				slog.Logf(logger.Levels.Error, "Not retrying: %s", err)
+				return err
+			} else if !ok {
+				return nil
+			}
 		}
 	}
 	slog.Logf(logger.Levels.Error, "Connection failed retries exceeded. Leftover: %d", src.buf.Len())
-	return nil //>>>>>>>>>>>>>>???????????????????????
+	return ErrRetriesExceeded
+}
+
+// batchOf checks that an object of the input is a batch. Anything else fails the client, since sending
+// it again would fail the same way.
+func batchOf(msg stream.Object) ([]byte, error) {
+	bytes, ok := msg.([]byte)
+	if !ok {
+		return nil, &stream.TypeMismatchError{Expected: reflect.TypeOf(bytes), Got: reflect.TypeOf(msg)}
+	}
+	return bytes, nil
+}
+
+// addPending adds the batch read from the input to the buffer. A batch the buffer fails to add, e.g. on
+// a disk error of a Spool, is kept pending and added again before reading the input.
+func (src *Client) addPending() (seq int, err error) {
+	seq, err = src.buf.Add(src.pending)
+	if err != nil {
+		slog.Logf(logger.Levels.Error, "Error adding item to buffer %v", err)
+		return 0, err
+	}
+	src.pending = nil
+	return seq, nil
+}
+
+// waitRetry waits before connecting again, buffering the input meanwhile so that a Spool keeps it through
+// outages of the server. It returns false when the client is stopped, and an error when the input is not
+// a batch.
+func (src *Client) waitRetry() (bool, error) {
+	retry := time.After(1 * time.Second)
+	upstreamClosed := false
+	for {
+		upstreamCh := src.In()
+		if !src.buf.CanAdd() || upstreamClosed || src.pending != nil {
+			upstreamCh = nil
+		}
+		select {
+		case msg, ok := <-upstreamCh:
+			if !ok {
+				//the next connection sends the buffer and closes
+				upstreamClosed = true
+				continue
+			}
+			bytes, err := batchOf(msg)
+			if err != nil {
+				return false, err
+			}
+			src.pending = bytes
+			src.addPending()
+		case <-retry:
+			return true, nil
+		case <-src.StopNotifier:
+			return false, nil
+		}
+	}
+}
+
+// Pending counts the batches waiting in the input channel and the ones sent but not yet acked
+func (src *Client) Pending() int {
+	n := src.GetInDepth() + src.buf.Len()
+	if src.pending != nil {
+		n++
+	}
+	return n
 }
 
 func (src Client) IsRunning() bool {
@@ -113,12 +270,51 @@ func (src *Client) resetAckTimer() (timer <-chan time.Time) {
 	return nil
 }
 
+func (src *Client) dial() (net.Conn, error) {
+	if src.tlsConfig == nil {
+		return net.Dial("tcp", src.addr)
+	}
+	dialer := &net.Dialer{Timeout: HANDSHAKE_TIMEOUT}
+	return tls.DialWithDialer(dialer, "tcp", src.addr, src.tlsConfig)
+}
+
+// handshake waits for the answer of the server to the hello. It returns nil without error when the client
+// is stopped.
+func (src *Client) handshake(rcvChData chan stream.Object) (*Welcome, error) {
+	select {
+	case obj, ok := <-rcvChData:
+		if !ok {
+			return nil, errors.New("Connection to Server was Broken during handshake")
+		}
+		command, _, payload, err := parseMsg(obj.([]byte), PROTOCOL_V0)
+		if err != nil {
+			return nil, err
+		}
+		if command == WELCOME {
+			return decodeWelcome(payload)
+		} else if command == REJECT {
+			return nil, &RejectedError{string(payload)}
+		}
+		return nil, &ProtocolError{fmt.Sprintf("Unexpected Command during handshake: %v", command), nil}
+	case <-time.After(HANDSHAKE_TIMEOUT):
+		return nil, errors.New("Time Out Waiting For Welcome")
+	case <-src.StopNotifier:
+		return nil, nil
+	}
+}
+
 func (src *Client) connect() error {
 	defer func() {
 		src.retries++
 	}()
 
-	conn, err := net.Dial("tcp", src.addr)
+	if src.pending != nil {
+		if _, err := src.addPending(); err != nil {
+			return err
+		}
+	}
+
+	conn, err := src.dial()
 	if err != nil {
 		slog.Logf(logger.Levels.Error, "Cannot establish a connection with %s %v", src.addr, err)
 		return err
@@ -161,12 +357,29 @@ func (src *Client) connect() error {
 	}()
 	//sender closed by closing the sndChData channel or by a hard stop
 
-	if src.buf.Len() > 0 {
-		leftover := src.buf.Reset()
-		for i, value := range leftover {
-			sendData(sndChData, value, i+1)
+	welcome := &Welcome{PROTOCOL_V0, COMPRESSION_NONE, ""}
+	if src.version > PROTOCOL_V0 {
+		sendHello(sndChData, src.hello())
+		if welcome, err = src.handshake(rcvChData); welcome == nil {
+			return err
+		}
+		if err = src.checkWelcome(welcome); err != nil {
+			return err
 		}
 	}
+	slog.Logf(logger.Levels.Debug, "Connected to %s with protocol %d, compression %s", src.addr, welcome.Version, welcome.Compression)
+	//the buffer keeps the batches uncompressed, the compression of the next connection may differ
+	dataCodec, err := getCodec(welcome.Compression)
+	if err != nil {
+		return &ProtocolError{"Server chose an unknown compression", err}
+	}
+	compression := newCompressionMetrics(stream.Name(src))
+
+	var leftover []util.Unacked
+	if src.buf.Len() > 0 {
+		leftover = src.buf.Reset()
+	}
+	resent := 0
 
 	timer := src.resetAckTimer()
 
@@ -176,13 +389,23 @@ func (src *Client) connect() error {
 	opName := stream.Name(src)
 	writesNotCompleted := uint(0)
 	for {
+		//the leftover can be larger than the send channel, it is sent as the writes complete, before new batches
+		for resent < len(leftover) && len(sndChData) < cap(sndChData) {
+			if err := sendBatch(sndChData, welcome.Version, dataCodec, compression, leftover[resent].Payload, leftover[resent].Seq); err != nil {
+				return err
+			}
+			resent++
+		}
+		if resent == len(leftover) {
+			leftover, resent = nil, 0
+		}
 		upstreamCh := src.In()
-		if !src.buf.CanAdd() || closing {
+		if !src.buf.CanAdd() || closing || leftover != nil || src.pending != nil {
 			//disable upstream listening
 			upstreamCh = nil
 		}
 		if closing && src.buf.Len() == 0 {
-			sendClose(sndChData, 100)
+			sendClose(sndChData, welcome.Version, 100)
 			return nil
 		}
 		select {
@@ -192,13 +415,18 @@ func (src *Client) connect() error {
 				//make sure everything was sent
 				closing = true
 			} else {
-				bytes := msg.([]byte)
-				seq, err := src.buf.Add(bytes)
+				bytes, err := batchOf(msg)
+				if err != nil {
+					return err
+				}
+				src.pending = bytes
+				seq, err := src.addPending()
 				if err != nil {
-					slog.Fatalf("Error adding item to buffer %v", err)
 					return err
 				}
-				sendData(sndChData, bytes, seq)
+				if err := sendBatch(sndChData, welcome.Version, dataCodec, compression, bytes, seq); err != nil {
+					return err
+				}
 				writesNotCompleted += 1
 				slog.Gm.Event(&opName) // These are batched
 				//slog.Logf(logger.Levels.Debug, "Sent batch -- length %d seq %d", len(bytes), seq)
@@ -215,16 +443,20 @@ func (src *Client) connect() error {
 				return errors.New("Connection to Server was Broken in Recieve Direction")
 			}
 
-			command, seq, _, err := parseMsg(obj.([]byte))
+			command, seq, _, err := parseMsg(obj.([]byte), welcome.Version)
 			if err != nil {
-				slog.Fatalf("%v", err)
+				return err
 			}
 			if command == ACK {
-				if src.processAck(seq) {
+				progress, err := src.processAck(seq)
+				if err != nil {
+					return err
+				}
+				if progress {
 					timer = src.resetAckTimer()
 				}
 			} else {
-				slog.Fatalf("Unknown Command: %v", command)
+				return &ProtocolError{fmt.Sprintf("Unknown Command: %v", command), nil}
 			}
 		case <-rcvChCloseNotifier:
 			//connection threw an eof to the reader?
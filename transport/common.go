@@ -3,7 +3,10 @@ package transport
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/cloudflare/golog/logger"
+	"math"
 	"github.com/cloudflare/go-stream/stream"
 	"github.com/cloudflare/go-stream/util/slog"
 )
@@ -16,49 +19,112 @@ const (
 	DATA = iota
 	ACK
 	CLOSE
+	//in 140516e command 3 was SESSION, the bare SessionId. Servers predating the handshake exit on it and
+	//current ones refuse it as a hello without PROTOCOL_MAGIC: clients built from that commit must not be deployed.
+	HELLO   //first message of a client connection, with the encoded Hello
+	WELCOME //answer to an accepted HELLO, with the encoded Welcome
+	REJECT  //answer to a rejected HELLO, with the reason, before closing the connection
 )
 
-func sendData(sndCh chan<- stream.Object, data []byte, seq int) {
-	sendMsgNoBlock(sndCh, DATA, seq, data)
+// ErrSendBufferFull is returned when a message does not fit in the send channel, which is sized to never block
+var ErrSendBufferFull = errors.New("Send channel full, should be non-blocking send")
+
+// ProtocolError is a message that could not be parsed or has an unexpected command
+type ProtocolError struct {
+	Msg string
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %v", e.Msg, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func sendData(sndCh chan<- stream.Object, version int, data []byte, seq int) error {
+	return sendMsgNoBlock(sndCh, version, DATA, seq, data)
 }
 
-func sendAck(sndCh chan<- stream.Object, seq int) {
+func sendAck(sndCh chan<- stream.Object, version int, seq int) {
 	slog.Logf(logger.Levels.Debug, "Sending back ack %d", seq)
-	sendMsg(sndCh, ACK, seq, []byte{})
+	sendMsg(sndCh, version, ACK, seq, []byte{})
 }
 
-func sendClose(sndCh chan<- stream.Object, seq int) {
+func sendClose(sndCh chan<- stream.Object, version int, seq int) {
 	slog.Logf(logger.Levels.Debug, "Sending Close %d", seq)
-	sendMsg(sndCh, CLOSE, seq, []byte{})
+	sendMsg(sndCh, version, CLOSE, seq, []byte{})
 }
 
-func sendMsg(sndCh chan<- stream.Object, command ZmqCommand, seq int, payload []byte) {
-	sndCh <- [][]byte{encodeInt(int(command)), encodeInt(seq), payload}
+//the handshake messages are sent before the version is known, in the PROTOCOL_V0 layout
+
+func sendHello(sndCh chan<- stream.Object, h *Hello) {
+	slog.Logf(logger.Levels.Debug, "Sending hello %v", h)
+	sendMsg(sndCh, PROTOCOL_V0, HELLO, h.Version, h.encode())
+}
+
+func sendWelcome(sndCh chan<- stream.Object, w *Welcome) {
+	slog.Logf(logger.Levels.Debug, "Sending welcome %v", w)
+	sendMsg(sndCh, PROTOCOL_V0, WELCOME, w.Version, w.encode())
+}
+
+func sendReject(sndCh chan<- stream.Object, reason string) {
+	slog.Logf(logger.Levels.Debug, "Sending reject %s", reason)
+	sendMsg(sndCh, PROTOCOL_V0, REJECT, 0, []byte(reason))
+}
+
+func sendMsg(sndCh chan<- stream.Object, version int, command ZmqCommand, seq int, payload []byte) {
+	sndCh <- [][]byte{encodeInt(int(command)), encodeSeq(version, seq), payload}
 }
 
-func sendMsgNoBlock(sndCh chan<- stream.Object, command ZmqCommand, seq int, payload []byte) {
+func sendMsgNoBlock(sndCh chan<- stream.Object, version int, command ZmqCommand, seq int, payload []byte) error {
 	select {
-	case sndCh <- [][]byte{encodeInt(int(command)), encodeInt(seq), payload}:
+	case sndCh <- [][]byte{encodeInt(int(command)), encodeSeq(version, seq), payload}:
+		return nil
 	default:
-		slog.Fatalf("%v", "Should be non-blocking send")
+		return ErrSendBufferFull
 	}
 }
 
-func parseMsg(msg []byte) (command ZmqCommand, seq int, payload []byte, err error) {
+// parseMsg parses a message in the layout of version. The command comes first in every layout, so the
+// handshake messages can be told apart before the version is known.
+func parseMsg(msg []byte, version int) (command ZmqCommand, seq int, payload []byte, err error) {
 	intsz := sizeInt()
+	if len(msg) < intsz {
+		return 0, 0, nil, &ProtocolError{fmt.Sprintf("Message too short, %d bytes", len(msg)), nil}
+	}
 	commandi, err := decodeInt(msg[0:intsz])
 	if err != nil {
-		slog.Fatalf("Could not parse command %v", err)
+		return 0, 0, nil, &ProtocolError{"Could not parse command", err}
 	}
 	command = ZmqCommand(commandi)
-	seq, err = decodeInt(msg[intsz:(intsz + intsz)])
+	if isHandshake(command) {
+		version = PROTOCOL_V0
+	}
+	seqsz := sizeSeq(version)
+	if len(msg) < intsz+seqsz {
+		return 0, 0, nil, &ProtocolError{fmt.Sprintf("Message too short, %d bytes", len(msg)), nil}
+	}
+	if version == PROTOCOL_V0 {
+		seq, err = decodeInt(msg[intsz:(intsz + seqsz)])
+	} else {
+		seq, err = decodeSeq(msg[intsz:(intsz + seqsz)])
+	}
 	if err != nil {
-		slog.Fatalf("Could not parse seq # %v", err)
+		return 0, 0, nil, &ProtocolError{"Could not parse seq #", err}
 	}
-	payload = msg[2*intsz:]
+	payload = msg[intsz+seqsz:]
 	return
 }
 
+func isHandshake(command ZmqCommand) bool {
+	return command == HELLO || command == WELCOME || command == REJECT
+}
+
 func encodeInt(val int) []byte {
 	if val < 0 {
 		panic("Can't encode negative val")
@@ -79,6 +145,33 @@ func decodeInt(val []byte) (n int, err error) {
 	return
 }
 
+// sizeSeq is the size of the sequence numbers of version. They are 32 bits in PROTOCOL_V0, where they
+// restart with every connection, and 64 bits since sessions keep them growing.
+func sizeSeq(version int) int {
+	if version == PROTOCOL_V0 {
+		return sizeInt()
+	}
+	return binary.Size(uint64(0))
+}
+
+func encodeSeq(version int, seq int) []byte {
+	if version == PROTOCOL_V0 {
+		return encodeInt(seq)
+	}
+	if seq < 0 {
+		panic("Can't encode negative seq")
+	}
+	return binary.LittleEndian.AppendUint64(nil, uint64(seq))
+}
+
+func decodeSeq(val []byte) (int, error) {
+	seq := binary.LittleEndian.Uint64(val)
+	if seq > math.MaxInt {
+		return 0, fmt.Errorf("Seq %d out of range", seq)
+	}
+	return int(seq), nil
+}
+
 func sizeInt() int {
 	var res uint32
 	return binary.Size(res)
@@ -0,0 +1,206 @@
+package transport
+
+import (
+	"bytes"
+	"code.google.com/p/snappy-go/snappy"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/golog/logger"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/util/slog"
+	"sync"
+)
+
+const (
+	COMPRESSION_SNAPPY = "snappy"
+	COMPRESSION_ZSTD   = "zstd"
+	COMPRESSION_GZIP   = "gzip"
+)
+
+// MAX_BATCH_SIZE bounds the size of a decompressed batch, so that a small payload can't exhaust the memory
+// of the server
+const MAX_BATCH_SIZE = 64 * 1024 * 1024
+
+var ErrBatchTooLarge = fmt.Errorf("Decompressed batch over %d bytes", MAX_BATCH_SIZE)
+
+// SUPPORTED_COMPRESSIONS is the default preference of servers
+var SUPPORTED_COMPRESSIONS = []string{COMPRESSION_ZSTD, COMPRESSION_SNAPPY, COMPRESSION_GZIP, COMPRESSION_NONE}
+
+// codec compresses the payload of DATA messages. Codecs are shared by the connections. decompress returns
+// ErrBatchTooLarge rather than decompressing more than MAX_BATCH_SIZE bytes.
+type codec interface {
+	compress(b []byte) ([]byte, error)
+	decompress(b []byte) ([]byte, error)
+}
+
+var codecs = map[string]codec{
+	COMPRESSION_NONE:   noneCodec{},
+	COMPRESSION_SNAPPY: snappyCodec{},
+	COMPRESSION_ZSTD:   &zstdCodec{},
+	COMPRESSION_GZIP:   &gzipCodec{},
+}
+
+func getCodec(compression string) (codec, error) {
+	c, ok := codecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported compression %s", compression)
+	}
+	return c, nil
+}
+
+// supported drops, with an error, the compressions there is no codec for
+func supported(compressions []string) []string {
+	res := make([]string, 0, len(compressions))
+	for _, c := range compressions {
+		if _, ok := codecs[c]; ok {
+			res = append(res, c)
+		} else {
+			slog.Logf(logger.Levels.Error, "Ignoring unsupported compression %s", c)
+		}
+	}
+	return res
+}
+
+type noneCodec struct{}
+
+func (noneCodec) compress(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (noneCodec) decompress(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b)
+}
+
+func (snappyCodec) decompress(b []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if n > MAX_BATCH_SIZE {
+		return nil, ErrBatchTooLarge
+	}
+	return snappy.Decode(nil, b)
+}
+
+// zstdCodec uses the stateless EncodeAll and DecodeAll, safe for concurrent use
+type zstdCodec struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		if c.enc, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAX_BATCH_SIZE))
+	})
+	return c.err
+}
+
+func (c *zstdCodec) compress(b []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(b, nil), nil
+}
+
+func (c *zstdCodec) decompress(b []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	res, err := c.dec.DecodeAll(b, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, ErrBatchTooLarge
+	}
+	return res, err
+}
+
+// gzipCodec pools its writers, which are expensive to allocate
+type gzipCodec struct {
+	writers sync.Pool
+}
+
+func (c *gzipCodec) compress(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		w = gzip.NewWriter(buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	res, err := io.ReadAll(io.LimitReader(r, MAX_BATCH_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > MAX_BATCH_SIZE {
+		return nil, ErrBatchTooLarge
+	}
+	return res, nil
+}
+
+// sendBatch compresses a batch with the codec of the connection
+func sendBatch(sndCh chan<- stream.Object, version int, c codec, m *compressionMetrics, payload []byte, seq int) error {
+	compressed, err := c.compress(payload)
+	if err != nil {
+		return err
+	}
+	m.update(len(payload), len(compressed))
+	return sendData(sndCh, version, compressed, seq)
+}
+
+// compressionMetrics counts the bytes of the batches before and after compression, in the registry of
+// slog.Gm. The ratio is of all the batches so far.
+type compressionMetrics struct {
+	raw        metrics.Counter
+	compressed metrics.Counter
+	ratio      metrics.GaugeFloat64
+}
+
+func newCompressionMetrics(op string) *compressionMetrics {
+	if slog.Gm == nil || slog.Gm.Reg == nil {
+		return &compressionMetrics{metrics.NewCounter(), metrics.NewCounter(), metrics.NewGaugeFloat64()}
+	}
+	reg := slog.Gm.Reg
+	return &compressionMetrics{
+		metrics.GetOrRegisterCounter(op+".compression.raw_bytes", reg),
+		metrics.GetOrRegisterCounter(op+".compression.compressed_bytes", reg),
+		metrics.GetOrRegisterGaugeFloat64(op+".compression.ratio", reg),
+	}
+}
+
+func (m *compressionMetrics) update(raw int, compressed int) {
+	m.raw.Inc(int64(raw))
+	m.compressed.Inc(int64(compressed))
+	if c := m.compressed.Count(); c > 0 {
+		m.ratio.Update(float64(m.raw.Count()) / float64(c))
+	}
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/util/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCodecs(t *testing.T) {
+	batch := bytes.Repeat([]byte("a compressible batch "), 100)
+	for _, compression := range SUPPORTED_COMPRESSIONS {
+		c, err := getCodec(compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := c.compress(batch)
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+		decompressed, err := c.decompress(compressed)
+		if err != nil || !bytes.Equal(decompressed, batch) {
+			t.Error(compression, "roundtrip failed", err)
+		}
+	}
+
+	if _, err := getCodec("lz4"); err == nil {
+		t.Error("Unknown compression should fail")
+	}
+	if _, err := codecs[COMPRESSION_GZIP].decompress(batch); err == nil {
+		t.Error("Decompressing garbage should fail")
+	}
+
+	//a small payload decompressing to more than MAX_BATCH_SIZE
+	bomb := make([]byte, MAX_BATCH_SIZE+1)
+	for _, compression := range []string{COMPRESSION_ZSTD, COMPRESSION_GZIP} {
+		compressed, err := codecs[compression].compress(bomb)
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+		if _, err := codecs[compression].decompress(compressed); !errors.Is(err, ErrBatchTooLarge) {
+			t.Error(compression, "expected ErrBatchTooLarge, got", err)
+		}
+	}
+}
+
+func TestUndecodableBatch(t *testing.T) {
+	addr := "127.0.0.1:4567"
+	s := NewServer(addr, DEFAULT_HWM)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	id := NewSessionId()
+	hello := &Hello{PROTOCOL_VERSION, PROTOCOL_V1, "test", id, []string{COMPRESSION_GZIP}, nil}
+	c := dialRaw(t, addr)
+	sendHello(c.snd, hello)
+	<-c.rcv
+	sendData(c.snd, PROTOCOL_V1, []byte("not gzip"), 1)
+	select {
+	case obj, ok := <-c.rcv:
+		if ok {
+			t.Error("Expected the connection to be closed, got", obj)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the connection to be closed")
+	}
+	c.close()
+
+	//the batch was not recorded as delivered, its resend is not a duplicate
+	c = dialRaw(t, addr)
+	sendHello(c.snd, hello)
+	<-c.rcv
+	compressed, _ := codecs[COMPRESSION_GZIP].compress([]byte("a"))
+	sendData(c.snd, PROTOCOL_V1, compressed, 1)
+	expectBatch(t, rcvch, "a")
+	c.close()
+
+	s.Stop()
+	wg.Wait()
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	addr := "127.0.0.1:4564"
+	for _, compression := range SUPPORTED_COMPRESSIONS {
+		s := NewServer(addr, DEFAULT_HWM)
+		rcvch := make(chan stream.Object, 100)
+		s.SetOut(rcvch)
+		wg := &sync.WaitGroup{}
+		StartOp(wg, s)
+		waitListening(t, addr)
+
+		datach := make(chan stream.Object, 100)
+		c := NewClient(addr, DEFAULT_HWM).SetCompressions("lz4", compression)
+		c.SetIn(datach)
+		StartOp(wg, c)
+
+		for i := 0; i < 10; i++ {
+			datach <- bytes.Repeat([]byte(fmt.Sprintf("batch %d ", i)), 100)
+		}
+		for i := 0; i < 10; i++ {
+			if res := <-rcvch; !bytes.Equal(res.([]byte), bytes.Repeat([]byte(fmt.Sprintf("batch %d ", i)), 100)) {
+				t.Error(compression, "wrong batch received")
+			}
+		}
+
+		c.Stop()
+		s.Stop()
+		wg.Wait()
+	}
+
+	//the batches are repetitive, the none transfer aside they shrink
+	for _, op := range []string{"*transport.Client", "transport.Server"} {
+		ratio := metrics.GetOrRegisterGaugeFloat64(op+".compression.ratio", slog.Gm.Reg).Value()
+		if ratio <= 1 {
+			t.Errorf("%s: expected a compression ratio above 1, got %v", op, ratio)
+		}
+	}
+}
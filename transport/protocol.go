@@ -0,0 +1,221 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// PROTOCOL_MAGIC starts the payload of a HELLO
+const PROTOCOL_MAGIC = "GSTR"
+
+const (
+	PROTOCOL_V0      = iota //no handshake or one downgraded to it, no sessions nor compression
+	PROTOCOL_V1             //HELLO handshake, sessions, 64 bit sequence numbers
+	PROTOCOL_VERSION = PROTOCOL_V1
+)
+
+const COMPRESSION_NONE = "none"
+
+// Hello is the first message of a client connection. The client speaks the versions from MinVersion to
+// Version and lists its capabilities by preference.
+type Hello struct {
+	Version      int
+	MinVersion   int
+	ClientId     string
+	Session      SessionId
+	Compressions []string
+	Encodings    []string
+}
+
+// Welcome is the answer of a server accepting a Hello, with the version and capabilities it chose.
+// Encoding is empty when the client did not list any.
+type Welcome struct {
+	Version     int
+	Compression string
+	Encoding    string
+}
+
+// RejectedError is returned by a client whose Hello was rejected by the server. It is not retried.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "Rejected by server: " + e.Reason
+}
+
+func defaultClientId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+func (h *Hello) encode() []byte {
+	w := &msgWriter{}
+	w.WriteString(PROTOCOL_MAGIC)
+	w.putInt(h.Version)
+	w.putInt(h.MinVersion)
+	w.putString(h.ClientId)
+	w.Write(h.Session[:])
+	w.putStrings(h.Compressions)
+	w.putStrings(h.Encodings)
+	return w.Bytes()
+}
+
+// decodeHello parses a Hello. Later versions may append fields, which are ignored.
+func decodeHello(payload []byte) (*Hello, error) {
+	if !bytes.HasPrefix(payload, []byte(PROTOCOL_MAGIC)) {
+		return nil, &ProtocolError{"Bad magic in hello", nil}
+	}
+	r := &msgReader{b: payload[len(PROTOCOL_MAGIC):]}
+	h := &Hello{}
+	h.Version = r.int()
+	h.MinVersion = r.int()
+	h.ClientId = r.string()
+	copy(h.Session[:], r.bytes(len(h.Session)))
+	h.Compressions = r.strings()
+	h.Encodings = r.strings()
+	if r.err != nil {
+		return nil, &ProtocolError{"Could not parse hello", r.err}
+	}
+	return h, nil
+}
+
+func (wl *Welcome) encode() []byte {
+	w := &msgWriter{}
+	w.putInt(wl.Version)
+	w.putString(wl.Compression)
+	w.putString(wl.Encoding)
+	return w.Bytes()
+}
+
+func decodeWelcome(payload []byte) (*Welcome, error) {
+	r := &msgReader{b: payload}
+	wl := &Welcome{r.int(), r.string(), r.string()}
+	if r.err != nil {
+		return nil, &ProtocolError{"Could not parse welcome", r.err}
+	}
+	return wl, nil
+}
+
+// negotiate picks the highest version both sides speak and the capabilities the server prefers among
+// the ones of the client. No compression is always possible; an encoding must be common to both sides
+// when the server lists some.
+func (src Server) negotiate(h *Hello) (*Welcome, error) {
+	version := h.Version
+	if version > src.maxVersion {
+		version = src.maxVersion
+	}
+	if version < h.MinVersion || version < src.minVersion {
+		return nil, fmt.Errorf("Unsupported protocol versions %d-%d, server speaks %d-%d",
+			h.MinVersion, h.Version, src.minVersion, src.maxVersion)
+	}
+
+	//PROTOCOL_V0 has no compression
+	compression := ""
+	if version > PROTOCOL_V0 {
+		compression = preferred(src.compressions, h.Compressions)
+	}
+	if compression == "" {
+		compression = COMPRESSION_NONE
+	}
+
+	encoding := ""
+	if len(h.Encodings) > 0 {
+		if src.encodings == nil {
+			encoding = h.Encodings[0]
+		} else if encoding = preferred(src.encodings, h.Encodings); encoding == "" {
+			return nil, fmt.Errorf("No common encoding in %v, server accepts %v", h.Encodings, src.encodings)
+		}
+	}
+
+	if src.checkHello != nil {
+		if err := src.checkHello(h); err != nil {
+			return nil, err
+		}
+	}
+	return &Welcome{version, compression, encoding}, nil
+}
+
+// preferred returns the first of ours also in theirs
+func preferred(ours []string, theirs []string) string {
+	for _, o := range ours {
+		for _, t := range theirs {
+			if o == t {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+type msgWriter struct {
+	bytes.Buffer
+}
+
+func (w *msgWriter) putInt(v int) {
+	w.Write(encodeInt(v))
+}
+
+func (w *msgWriter) putString(s string) {
+	w.putInt(len(s))
+	w.WriteString(s)
+}
+
+func (w *msgWriter) putStrings(l []string) {
+	w.putInt(len(l))
+	for _, s := range l {
+		w.putString(s)
+	}
+}
+
+// msgReader reads the fields written by msgWriter, keeping the first error
+type msgReader struct {
+	b   []byte
+	err error
+}
+
+func (r *msgReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = fmt.Errorf("Message truncated, %d bytes left, %d needed", len(r.b), n)
+		return nil
+	}
+	res := r.b[:n]
+	r.b = r.b[n:]
+	return res
+}
+
+func (r *msgReader) int() int {
+	b := r.bytes(sizeInt())
+	if b == nil {
+		return 0
+	}
+	n, err := decodeInt(b)
+	if err != nil {
+		r.err = err
+	}
+	return n
+}
+
+func (r *msgReader) string() string {
+	return string(r.bytes(r.int()))
+}
+
+func (r *msgReader) strings() []string {
+	n := r.int()
+	if n > len(r.b) {
+		r.err = fmt.Errorf("Bad list length %d", n)
+		return nil
+	}
+	l := make([]string, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		l = append(l, r.string())
+	}
+	return l
+}
@@ -0,0 +1,274 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/stream/source"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHelloEncoding(t *testing.T) {
+	h := &Hello{3, 1, "edge-1", NewSessionId(), []string{"snappy", COMPRESSION_NONE}, []string{"gob"}}
+	decoded, err := decodeHello(h.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, decoded) {
+		t.Errorf("Expected %v, got %v", h, decoded)
+	}
+
+	if _, err := decodeHello([]byte("junk")); err == nil {
+		t.Error("Bad magic should fail")
+	}
+	if _, err := decodeHello(h.encode()[:20]); err == nil {
+		t.Error("Truncated hello should fail")
+	}
+
+	w := &Welcome{1, COMPRESSION_NONE, "gob"}
+	if decoded, err := decodeWelcome(w.encode()); err != nil || *decoded != *w {
+		t.Errorf("Expected %v, got %v %v", w, decoded, err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	s := NewServer(":0", DEFAULT_HWM)
+	hello := func(version int, min int, compressions []string, encodings []string) *Hello {
+		return &Hello{version, min, "edge-1", NewSessionId(), compressions, encodings}
+	}
+
+	//a newer client is downgraded
+	w, err := s.negotiate(hello(PROTOCOL_VERSION+1, PROTOCOL_V1, nil, nil))
+	if err != nil || w.Version != PROTOCOL_VERSION || w.Compression != COMPRESSION_NONE || w.Encoding != "" {
+		t.Error("Expected a downgrade, got", w, err)
+	}
+	if _, err := s.negotiate(hello(PROTOCOL_VERSION+2, PROTOCOL_VERSION+1, nil, nil)); err == nil {
+		t.Error("A client that can't downgrade should be rejected")
+	}
+	s.SetProtocolVersions(PROTOCOL_V1+1, PROTOCOL_V1+1)
+	if _, err := s.negotiate(hello(PROTOCOL_V1, PROTOCOL_V1, nil, nil)); err == nil {
+		t.Error("An old client should be rejected")
+	}
+	s.SetProtocolVersions(PROTOCOL_V0, PROTOCOL_VERSION)
+
+	//server preferences win
+	s.SetCapabilities([]string{"zstd", "snappy", COMPRESSION_NONE}, []string{"json", "gob"})
+	w, err = s.negotiate(hello(PROTOCOL_VERSION, PROTOCOL_V1, []string{COMPRESSION_NONE, "snappy"}, []string{"gob", "json"}))
+	if err != nil || w.Compression != "snappy" || w.Encoding != "json" {
+		t.Error("Wrong capabilities", w, err)
+	}
+	w, err = s.negotiate(hello(PROTOCOL_VERSION, PROTOCOL_V1, []string{"lz4"}, nil))
+	if err != nil || w.Compression != COMPRESSION_NONE {
+		t.Error("Compression should fall back to none", w, err)
+	}
+	if _, err := s.negotiate(hello(PROTOCOL_VERSION, PROTOCOL_V1, nil, []string{"protobuf"})); err == nil {
+		t.Error("A client without a common encoding should be rejected")
+	}
+
+	//a client downgraded to PROTOCOL_V0 gets no compression
+	s.SetProtocolVersions(PROTOCOL_V0, PROTOCOL_V0)
+	w, err = s.negotiate(hello(PROTOCOL_VERSION, PROTOCOL_V0, []string{"snappy"}, nil))
+	if err != nil || w.Version != PROTOCOL_V0 || w.Compression != COMPRESSION_NONE {
+		t.Error("Expected a downgrade without compression", w, err)
+	}
+	s.SetProtocolVersions(PROTOCOL_V0, PROTOCOL_VERSION)
+
+	s.SetHelloCheck(func(h *Hello) error {
+		if h.ClientId != "edge-2" {
+			return errors.New("Unknown client")
+		}
+		return nil
+	})
+	if _, err := s.negotiate(hello(PROTOCOL_VERSION, PROTOCOL_V1, nil, nil)); err == nil {
+		t.Error("The hello check should reject the client")
+	}
+}
+
+func TestCheckWelcome(t *testing.T) {
+	c := NewClient(":0", DEFAULT_HWM).SetCompressions(COMPRESSION_GZIP).SetEncodings("json")
+	for _, test := range []struct {
+		welcome Welcome
+		ok      bool
+	}{
+		{Welcome{PROTOCOL_V1, COMPRESSION_GZIP, "json"}, true},
+		{Welcome{PROTOCOL_V1, COMPRESSION_NONE, ""}, true},
+		{Welcome{PROTOCOL_V0, COMPRESSION_NONE, ""}, false},
+		{Welcome{PROTOCOL_VERSION + 1, COMPRESSION_NONE, ""}, false},
+		{Welcome{PROTOCOL_V1, "zstd", ""}, false},
+		{Welcome{PROTOCOL_V1, COMPRESSION_NONE, "gob"}, false},
+	} {
+		var protocolErr *ProtocolError
+		if err := c.checkWelcome(&test.welcome); (err == nil) != test.ok || (err != nil && !errors.As(err, &protocolErr)) {
+			t.Error("Wrong check of", test.welcome, err)
+		}
+	}
+
+	//PROTOCOL_V0 is accepted once the client allows it, without compression
+	c.SetProtocolVersions(PROTOCOL_V0, PROTOCOL_VERSION)
+	if err := c.checkWelcome(&Welcome{PROTOCOL_V0, COMPRESSION_NONE, ""}); err != nil {
+		t.Error("Expected a downgrade to be accepted", err)
+	}
+	if err := c.checkWelcome(&Welcome{PROTOCOL_V0, COMPRESSION_GZIP, ""}); err == nil {
+		t.Error("PROTOCOL_V0 has no compression")
+	}
+}
+
+func TestHandshakeDowngrade(t *testing.T) {
+	addr := "127.0.0.1:4572"
+	s := NewServer(addr, DEFAULT_HWM).SetProtocolVersions(PROTOCOL_V0, PROTOCOL_V0)
+	s.SetCapabilities([]string{COMPRESSION_GZIP}, nil)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	datach := make(chan stream.Object, 100)
+	c := NewClient(addr, DEFAULT_HWM).SetProtocolVersions(PROTOCOL_V0, PROTOCOL_VERSION).SetCompressions(COMPRESSION_GZIP)
+	c.SetIn(datach)
+	StartOp(wg, c)
+	for i := 0; i < 5; i++ {
+		datach <- []byte(fmt.Sprintf("batch %d", i))
+	}
+	for i := 0; i < 5; i++ {
+		expectBatch(t, rcvch, fmt.Sprintf("batch %d", i))
+	}
+
+	c.Stop()
+	s.Stop()
+	wg.Wait()
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	addr := "127.0.0.1:4562"
+	s := NewServer(addr, DEFAULT_HWM).SetCapabilities(nil, []string{"json"})
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	c := NewClient(addr, DEFAULT_HWM).SetEncodings("gob")
+	c.SetIn(make(chan stream.Object, 1))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Run()
+	}()
+	select {
+	case err := <-errs:
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) {
+			t.Error("Expected a rejection, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("A rejected client should not retry")
+		c.Stop()
+	}
+
+	s.Stop()
+	wg.Wait()
+}
+
+func TestHandshakeLegacy(t *testing.T) {
+	addr := "127.0.0.1:4563"
+	for _, min := range []int{PROTOCOL_V0, PROTOCOL_V1} {
+		s := NewServer(addr, DEFAULT_HWM).SetProtocolVersions(min, PROTOCOL_VERSION)
+		rcvch := make(chan stream.Object, 100)
+		s.SetOut(rcvch)
+		wg := &sync.WaitGroup{}
+		StartOp(wg, s)
+		waitListening(t, addr)
+
+		//a client predating the handshake
+		c := dialRaw(t, addr)
+		sendData(c.snd, PROTOCOL_V0, []byte("a"), 1)
+		sendData(c.snd, PROTOCOL_V0, []byte("a"), 1)
+		select {
+		case <-rcvch:
+			if min > PROTOCOL_V0 {
+				t.Error("Clients without handshake should be refused")
+			}
+		case <-time.After(500 * time.Millisecond):
+			if min == PROTOCOL_V0 {
+				t.Error("Clients without handshake should be accepted")
+			}
+		}
+		if min == PROTOCOL_V0 {
+			//there is no session to deduplicate with
+			expectBatch(t, rcvch, "a")
+		}
+		c.close()
+
+		s.Stop()
+		wg.Wait()
+	}
+}
+
+// legacyServer acks and forwards the batches of one connection like the servers predating the handshake,
+// which close the connection on any other command
+func legacyServer(t *testing.T, addr string, rcvch chan stream.Object) (unknown chan ZmqCommand) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown = make(chan ZmqCommand, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &rawConn{make(chan stream.Object, 10), make(chan stream.Object, 10), &sync.WaitGroup{}}
+		sender := sink.NewMultiPartWriterSink(conn)
+		sender.SetIn(c.snd)
+		receiver := source.NewIOReaderSourceLengthDelim(conn)
+		receiver.SetOut(c.rcv)
+		StartOp(c.wg, sender)
+		StartOp(c.wg, receiver)
+		defer c.close()
+		for obj := range c.rcv {
+			command, seq, payload, err := parseMsg(obj.([]byte), PROTOCOL_V0)
+			if err != nil || command != DATA {
+				unknown <- command
+				return
+			}
+			rcvch <- payload
+			sendAck(c.snd, PROTOCOL_V0, seq)
+		}
+	}()
+	return unknown
+}
+
+func TestClientLegacyServer(t *testing.T) {
+	addr := "127.0.0.1:4566"
+	rcvch := make(chan stream.Object, 100)
+	unknown := legacyServer(t, addr, rcvch)
+
+	datach := make(chan stream.Object, 100)
+	c := NewClient(addr, DEFAULT_HWM).SetProtocolVersions(PROTOCOL_V0, PROTOCOL_V0).SetCompressions(COMPRESSION_GZIP)
+	c.SetIn(datach)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, c)
+	for i := 0; i < 5; i++ {
+		datach <- []byte(fmt.Sprintf("batch %d", i))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case res := <-rcvch:
+			if string(res.([]byte)) != fmt.Sprintf("batch %d", i) {
+				t.Error("Wrong batch received", string(res.([]byte)))
+			}
+		case command := <-unknown:
+			t.Fatal("Legacy server got command", command)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Batch not received", i)
+		}
+	}
+	c.Stop()
+	wg.Wait()
+}
@@ -3,6 +3,7 @@ package transport
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	metrics "github.com/rcrowley/go-metrics"
 	"io"
@@ -22,7 +23,7 @@ func TestSimpleTransfer(t *testing.T) {
 		slog.DEFAULT_STATS_LOG_LEVEL,
 		slog.DEFAULT_STATS_LOG_PREFIX,
 		baseutil.NewStreamingMetrics(metrics.NewRegistry()),
-		slog.DEFAULT_STATS_ADDR)
+		slog.DEFAULT_STATS_ADDR, "", "")
 
 	datach := make(chan stream.Object, 100)
 	c := DefaultClient("127.0.0.1")
@@ -293,3 +294,36 @@ func TestSoftClose(t *testing.T) {
 	log.Println("Waitiong For Server To Exit")
 	wg1.Wait()
 }
+
+func TestClientNotBatch(t *testing.T) {
+	addr := "127.0.0.1:4568"
+	s := NewServer(addr, DEFAULT_HWM)
+	s.SetOut(make(chan stream.Object, 100))
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+	defer wg.Wait()
+	defer s.Stop()
+
+	//connected, and waiting to connect again to a server that is down
+	for _, addr := range []string{addr, "127.0.0.1:4569"} {
+		datach := make(chan stream.Object, 1)
+		c := NewClient(addr, DEFAULT_HWM)
+		c.SetIn(datach)
+		datach <- "not a batch"
+		errs := make(chan error, 1)
+		go func() {
+			errs <- c.Run()
+		}()
+		select {
+		case err := <-errs:
+			var mismatch *stream.TypeMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Error("Expected a type mismatch, got ", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("Client kept running on an object that is not a batch", addr)
+			c.Stop()
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package transport
 
 import (
+	"crypto/tls"
+	"fmt"
 	"github.com/cloudflare/golog/logger"
 	"net"
 	"github.com/cloudflare/go-stream/stream"
@@ -17,6 +19,14 @@ type Server struct {
 	addr            string
 	hwm             int
 	EnableSoftClose bool
+	tlsConfig       *tls.Config
+	authorize       PeerAuthorizer
+	sessions        *sessionTable
+	minVersion      int
+	maxVersion      int
+	compressions    []string
+	encodings       []string
+	checkHello      func(h *Hello) error
 }
 
 func DefaultServer() *Server {
@@ -24,7 +34,8 @@ func DefaultServer() *Server {
 }
 
 func NewServer(addr string, highWaterMark int) *Server {
-	zmqsrc := Server{stream.NewHardStopChannelCloser(), stream.NewBaseOut(stream.CHAN_SLACK), addr, highWaterMark, false}
+	zmqsrc := Server{stream.NewHardStopChannelCloser(), stream.NewBaseOut(stream.CHAN_SLACK), addr, highWaterMark, false, nil, nil, newSessionTable(),
+		PROTOCOL_V0, PROTOCOL_VERSION, SUPPORTED_COMPRESSIONS, nil, nil}
 
 	return &zmqsrc
 }
@@ -34,6 +45,44 @@ func (s *Server) SetEnableSoftClose(flag bool) *Server {
 	return s
 }
 
+// SetTLSConfig makes the server accept TLS connections only. Set ClientAuth and ClientCAs in config to
+// require client certificates.
+func (s *Server) SetTLSConfig(config *tls.Config) *Server {
+	s.tlsConfig = config
+	return s
+}
+
+// SetAuthorizer sets the hook deciding which clients may send data, called after the TLS handshake.
+// Rejected connections are closed before anything is read.
+func (s *Server) SetAuthorizer(a PeerAuthorizer) *Server {
+	s.authorize = a
+	return s
+}
+
+// SetProtocolVersions sets the versions the server speaks. Clients speaking a higher version are downgraded
+// to max if they can, the others are rejected. With min above PROTOCOL_V0 the clients predating the
+// handshake are refused.
+func (s *Server) SetProtocolVersions(min int, max int) *Server {
+	s.minVersion = min
+	s.maxVersion = max
+	return s
+}
+
+// SetCapabilities sets the compressions and encodings the server accepts, by preference. Clients are
+// rejected when they list encodings and none of them is accepted; nil encodings accept any. Clients
+// offering none of the compressions send their batches uncompressed.
+func (s *Server) SetCapabilities(compressions []string, encodings []string) *Server {
+	s.compressions = supported(compressions)
+	s.encodings = encodings
+	return s
+}
+
+// SetHelloCheck sets a hook to reject clients by their Hello, after the negotiation succeeded
+func (s *Server) SetHelloCheck(check func(h *Hello) error) *Server {
+	s.checkHello = check
+	return s
+}
+
 func hardCloseListener(hcn chan bool, sfc chan bool, listener net.Listener) {
 	select {
 	case <-hcn:
@@ -58,6 +107,9 @@ func (src Server) Run() error {
 		slog.Logf(logger.Levels.Error, "Error listening %v", err)
 		return err
 	}
+	if src.tlsConfig != nil {
+		ln = tls.NewListener(ln, src.tlsConfig)
+	}
 
 	wg_sub := &sync.WaitGroup{}
 	defer wg_sub.Wait()
@@ -112,13 +164,21 @@ func (src Server) Run() error {
 			defer wg_sub.Done()
 			defer wg_scl.Done()
 			defer conn.Close() //handle connection will close conn because of reader and writer. But just as good coding practice
-			src.handleConnection(conn)
+			if err := handshake(conn, src.authorize); err != nil {
+				slog.Logf(logger.Levels.Error, "Rejecting connection from %v: %v", conn.RemoteAddr(), err)
+				return
+			}
+			if err := src.handleConnection(conn); err != nil {
+				slog.Logf(logger.Levels.Error, "Closing connection from %v: %v", conn.RemoteAddr(), err)
+			}
 		}()
 	}
 
 }
 
-func (src Server) handleConnection(conn net.Conn) {
+// handleConnection returns the protocol errors of the client, which end its connection. The batches of
+// a session that were already sent downstream, on this connection or a previous one, are acked and dropped.
+func (src Server) handleConnection(conn net.Conn) error {
 	wg_sub := &sync.WaitGroup{}
 	defer wg_sub.Wait()
 
@@ -127,7 +187,9 @@ func (src Server) handleConnection(conn net.Conn) {
 	sndChCloseNotifier := make(chan bool, 1)
 	defer close(sndChData)
 	//side effect: this will close conn on exit
+	writeNotifier := stream.NewNonBlockingProcessedNotifier(2)
 	sender := sink.NewMultiPartWriterSink(conn)
+	sender.CompletedNotifier = writeNotifier
 	sender.SetIn(sndChData)
 	wg_sub.Add(1)
 	go func() {
@@ -156,6 +218,17 @@ func (src Server) handleConnection(conn net.Conn) {
 	}()
 	defer receiver.Stop()
 
+	var welcome *Welcome //nil until the handshake, PROTOCOL_V0 clients have none
+	version := PROTOCOL_V0
+	var dataCodec codec = noneCodec{}
+	compression := newCompressionMetrics(opName)
+	handshaken := false
+	var sess *session
+	defer func() {
+		if sess != nil {
+			src.sessions.close(sess)
+		}
+	}()
 	lastGotAck := 0
 	lastSentAck := 0
 	var timer <-chan time.Time
@@ -167,50 +240,100 @@ func (src Server) handleConnection(conn net.Conn) {
 			if !ok {
 				//send last ack back??
 				slog.Logf(logger.Levels.Error, "Receive Channel Closed Without Close Message")
-				return
+				return nil
 			}
-			command, seq, payload, err := parseMsg(obj.([]byte))
+			command, seq, payload, err := parseMsg(obj.([]byte), version)
 			slog.Gm.Event(&opName)
 
+			if err == nil && !handshaken && command != HELLO && src.minVersion > PROTOCOL_V0 {
+				return &ProtocolError{"Handshake required", nil}
+			}
+			//a client starting without a hello predates the handshake, it speaks PROTOCOL_V0
+			handshaken = handshaken || command != HELLO
 			if err == nil {
 				if command == DATA {
-					lastGotAck = seq
+					//a batch that can't be decompressed is neither acked nor recorded as delivered, the
+					//client sends it again
+					batch, err := dataCodec.decompress(payload)
+					if err != nil {
+						return &ProtocolError{fmt.Sprintf("Could not decompress batch %d", seq), err}
+					}
+					if seq > lastGotAck {
+						lastGotAck = seq
+					}
 					if (lastGotAck - lastSentAck) > src.hwm/2 {
-						sendAck(sndChData, lastGotAck)
+						sendAck(sndChData, version, lastGotAck)
 						lastSentAck = lastGotAck
 						timer = nil
 					} else if timer == nil {
 						slog.Logf(logger.Levels.Debug, "Setting timer %v", time.Now())
 						timer = time.After(100 * time.Millisecond)
 					}
-					src.Out() <- payload
+					if sess == nil || src.sessions.deliver(sess, seq) {
+						compression.update(len(batch), len(payload))
+						src.Out() <- batch
+					} else {
+						slog.Logf(logger.Levels.Debug, "Dropping duplicate batch %d", seq)
+					}
+				} else if command == HELLO {
+					if handshaken {
+						return &ProtocolError{"Unexpected hello", nil}
+					}
+					hello, err := decodeHello(payload)
+					if err != nil {
+						return err
+					}
+					welcome, err = src.negotiate(hello)
+					if err != nil {
+						sendReject(sndChData, err.Error())
+						//the sender is stopped on return, give it time to write the reason
+						select {
+						case <-writeNotifier.NotificationChannel():
+						case <-sndChCloseNotifier:
+						case <-time.After(HANDSHAKE_TIMEOUT):
+						}
+						return fmt.Errorf("Rejected client %s: %v", hello.ClientId, err)
+					}
+					if dataCodec, err = getCodec(welcome.Compression); err != nil {
+						return err
+					}
+					sendWelcome(sndChData, welcome)
+					version = welcome.Version
+					handshaken = true
+					//sessions came with PROTOCOL_V1, the batches of a client downgraded to PROTOCOL_V0 are
+					//not deduplicated
+					if version > PROTOCOL_V0 {
+						sess = src.sessions.open(hello.Session)
+					}
+					slog.Logf(logger.Levels.Info, "Client %s connected with protocol %d, compression %s",
+						hello.ClientId, welcome.Version, welcome.Compression)
 				} else if command == CLOSE {
 					if lastGotAck > lastSentAck {
-						sendAck(sndChData, lastGotAck)
+						sendAck(sndChData, version, lastGotAck)
 					}
 					slog.Logf(logger.Levels.Info, "%s", "Server got close")
-					return
+					return nil
 				} else {
-					slog.Fatalf("%v", "Server Got Unknown Command")
+					return &ProtocolError{fmt.Sprintf("Server Got Unknown Command %v", command), nil}
 				}
 			} else {
-				slog.Fatalf("Server could not parse packet: %v", err)
+				return err
 			}
 		case <-rcvChCloseNotifier:
 			if len(rcvChData) > 0 {
 				continue //drain channel before exiting
 			}
 			slog.Logf(logger.Levels.Error, "Client asked for a close on recieve- should not happen, timer is nil = %v, %v", (timer == nil), time.Now())
-			return
+			return nil
 		case <-sndChCloseNotifier:
 			slog.Logf(logger.Levels.Error, "%v", "Server asked for a close on send - should not happen")
-			return
+			return nil
 		case <-timer:
-			sendAck(sndChData, lastGotAck)
+			sendAck(sndChData, version, lastGotAck)
 			lastSentAck = lastGotAck
 			timer = nil
 		case <-src.StopNotifier:
-			return
+			return nil
 		}
 
 	}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/cloudflare/go-stream/util"
+	"sync"
+	"time"
+)
+
+// SESSION_TTL is how long a server remembers a session after its last connection ended
+const SESSION_TTL = 1 * time.Hour
+
+// SessionId identifies the batches of a client across its connections. Sequence numbers are not
+// reset when reconnecting, so the server drops the batches of a session it already received.
+type SessionId [16]byte
+
+func NewSessionId() SessionId {
+	var id SessionId
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id SessionId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SessionBuffer is a buffer keeping the session of its batches, for the batches it keeps across restarts
+// of the process to be deduplicated too. Spool is one.
+type SessionBuffer interface {
+	util.SequentialBuffer
+	Session() SessionId
+}
+
+type session struct {
+	lastSeq     int //last batch sent downstream
+	connections int
+	seen        time.Time
+}
+
+// sessionTable is the dedup state of a server, shared by its connections
+type sessionTable struct {
+	lock     sync.Mutex
+	sessions map[SessionId]*session
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[SessionId]*session)}
+}
+
+// open returns the session of a new connection and forgets the sessions that expired
+func (t *sessionTable) open(id SessionId) *session {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	for k, s := range t.sessions {
+		if s.connections == 0 && now.Sub(s.seen) > SESSION_TTL {
+			delete(t.sessions, k)
+		}
+	}
+	s, ok := t.sessions[id]
+	if !ok {
+		s = &session{}
+		t.sessions[id] = s
+	}
+	s.connections++
+	return s
+}
+
+func (t *sessionTable) close(s *session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s.connections--
+	s.seen = time.Now()
+}
+
+// deliver returns true for the batches not received yet, which are then sent downstream
+func (t *sessionTable) deliver(s *session, seq int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if seq <= s.lastSeq {
+		return false
+	}
+	s.lastSeq = seq
+	return true
+}
@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"net"
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/stream/sink"
+	"github.com/cloudflare/go-stream/stream/source"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rawConn speaks the protocol directly, to replay what a client sends after losing a connection
+type rawConn struct {
+	snd chan stream.Object
+	rcv chan stream.Object
+	wg  *sync.WaitGroup
+}
+
+func dialRaw(t *testing.T, addr string) *rawConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &rawConn{make(chan stream.Object, 10), make(chan stream.Object, 10), &sync.WaitGroup{}}
+	sender := sink.NewMultiPartWriterSink(conn)
+	sender.SetIn(c.snd)
+	receiver := source.NewIOReaderSourceLengthDelim(conn)
+	receiver.SetOut(c.rcv)
+	StartOp(c.wg, sender)
+	StartOp(c.wg, receiver)
+	return c
+}
+
+// hello opens a session and checks the server accepted it
+func (c *rawConn) hello(t *testing.T, id SessionId) {
+	sendHello(c.snd, &Hello{PROTOCOL_VERSION, PROTOCOL_V1, "test", id, nil, nil})
+	select {
+	case obj := <-c.rcv:
+		if command, _, _, err := parseMsg(obj.([]byte), PROTOCOL_V0); err != nil || command != WELCOME {
+			t.Fatal("Expected a welcome, got", command, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a welcome")
+	}
+}
+
+// close waits for the last messages to be written and closes the connection
+func (c *rawConn) close() {
+	close(c.snd)
+	c.wg.Wait()
+}
+
+func expectBatch(t *testing.T, rcvch chan stream.Object, expected string) {
+	select {
+	case res := <-rcvch:
+		if string(res.([]byte)) != expected {
+			t.Errorf("Expected %s, got %s", expected, res.([]byte))
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected", expected)
+	}
+}
+
+func TestSessionDedup(t *testing.T) {
+	addr := "127.0.0.1:4561"
+	s := NewServer(addr, DEFAULT_HWM)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	id := NewSessionId()
+	c := dialRaw(t, addr)
+	c.hello(t, id)
+	sendData(c.snd, PROTOCOL_V1, []byte("a"), 1)
+	sendData(c.snd, PROTOCOL_V1, []byte("b"), 2)
+	expectBatch(t, rcvch, "a")
+	expectBatch(t, rcvch, "b")
+	//the connection broke before the ack
+	c.close()
+
+	c = dialRaw(t, addr)
+	c.hello(t, id)
+	sendData(c.snd, PROTOCOL_V1, []byte("b"), 2)
+	sendData(c.snd, PROTOCOL_V1, []byte("c"), 3)
+	expectBatch(t, rcvch, "c")
+	select {
+	case obj := <-c.rcv:
+		//duplicates are acked too
+		if command, seq, _, err := parseMsg(obj.([]byte), PROTOCOL_V1); err != nil || command != ACK || seq != 3 {
+			t.Error("Expected an ack of 3, got", command, seq, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected an ack")
+	}
+	c.close()
+
+	//another session has sequence numbers of its own
+	c = dialRaw(t, addr)
+	c.hello(t, NewSessionId())
+	sendData(c.snd, PROTOCOL_V1, []byte("x"), 1)
+	expectBatch(t, rcvch, "x")
+	c.close()
+
+	if len(rcvch) != 0 {
+		t.Error("Duplicates were sent downstream", len(rcvch))
+	}
+	s.Stop()
+	wg.Wait()
+}
+
+func TestSessionSeqWrap(t *testing.T) {
+	addr := "127.0.0.1:4570"
+	s := NewServer(addr, DEFAULT_HWM)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	//the sequence numbers of a session go past 32 bits
+	c := dialRaw(t, addr)
+	c.hello(t, NewSessionId())
+	for i, batch := range []string{"a", "b", "c"} {
+		sendData(c.snd, PROTOCOL_V1, []byte(batch), 1<<32-1+i)
+		expectBatch(t, rcvch, batch)
+	}
+	for acked := 0; acked != 1<<32+1; {
+		select {
+		case obj := <-c.rcv:
+			command, seq, _, err := parseMsg(obj.([]byte), PROTOCOL_V1)
+			if err != nil || command != ACK || seq < 1<<32-1 {
+				t.Fatal("Expected an ack from 2^32-1, got", command, seq, err)
+			}
+			acked = seq
+		case <-time.After(time.Second):
+			t.Fatal("Expected an ack of 2^32+1")
+		}
+	}
+	c.close()
+
+	s.Stop()
+	wg.Wait()
+}
+
+func TestSessionCommandRefused(t *testing.T) {
+	addr := "127.0.0.1:4571"
+	s := NewServer(addr, DEFAULT_HWM)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	//the SESSION command of 140516e
+	id := NewSessionId()
+	c := dialRaw(t, addr)
+	sendMsg(c.snd, PROTOCOL_V0, HELLO, 0, id[:])
+	sendData(c.snd, PROTOCOL_V0, []byte("a"), 1)
+	select {
+	case obj, ok := <-c.rcv:
+		if ok {
+			t.Error("Expected the connection to be closed, got", obj)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the connection to be closed")
+	}
+	c.close()
+	if len(rcvch) != 0 {
+		t.Error("The batch should not be sent downstream")
+	}
+
+	//the server goes on with other clients
+	c = dialRaw(t, addr)
+	c.hello(t, NewSessionId())
+	sendData(c.snd, PROTOCOL_V1, []byte("b"), 1)
+	expectBatch(t, rcvch, "b")
+	c.close()
+
+	s.Stop()
+	wg.Wait()
+}
@@ -0,0 +1,457 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/golog/logger"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"github.com/cloudflare/go-stream/util"
+	"github.com/cloudflare/go-stream/util/slog"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type SyncPolicy int
+
+const (
+	SYNC_NONE    SyncPolicy = iota //writes are flushed by the OS, a crash of the host may lose the last batches
+	SYNC_SEGMENT                   //segments are synced when full and on Close
+	SYNC_ALWAYS                    //every batch and ack is synced before Add and Ack return
+)
+
+const (
+	DEFAULT_SEGMENT_SIZE = 64 * 1024 * 1024
+	SPOOL_ACK_FILE       = "ack"
+	SPOOL_SESSION_FILE   = "session"
+	SPOOL_SEGMENT_SUFFIX = ".seg"
+	spoolHeaderSize      = 8 //length and crc of a record
+)
+
+var ErrSpoolFull = errors.New("Spool full")
+var ErrSpoolClosed = errors.New("Spool closed")
+
+// SpoolConfig caps a spool to MaxItems batches and MaxBytes of payload, 0 is unlimited. Batches are
+// appended to segment files of SegmentSize bytes, DEFAULT_SEGMENT_SIZE if 0.
+type SpoolConfig struct {
+	MaxItems    int
+	MaxBytes    int64
+	SegmentSize int64
+	Sync        SyncPolicy
+}
+
+type spoolSegment struct {
+	first uint64 //id of the first record, the name of the file
+	count int
+	size  int64
+}
+
+type spoolRecord struct {
+	id      uint64
+	segment *spoolSegment
+	offset  int64
+	length  int
+}
+
+// Spool is a SequentialBuffer keeping the unacked batches of a Client on disk, so that they survive
+// restarts of the process. The sequence number of a batch is a persistent id; the id of the last acked one
+// is kept in the ack file and segments are deleted once all their batches are acked. Opening a spool loads
+// the unacked batches, which the client sends before the new ones when it connects. The spool keeps its
+// session too, for the server to drop the batches it received before the restart.
+type Spool struct {
+	dir      string
+	config   SpoolConfig
+	lock     sync.Mutex
+	segments []*spoolSegment
+	file     *os.File //last segment, open for appending
+	records  []spoolRecord
+	bytes    int64
+	nextId   uint64
+	ackedId  uint64
+	session  SessionId
+	closed   bool
+}
+
+// OpenSpool opens the spool in dir, creating it if needed, and loads the batches that were not acked.
+// A partially written batch at the end of a segment, left by a crash, is truncated.
+func OpenSpool(dir string, config SpoolConfig) (*Spool, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DEFAULT_SEGMENT_SIZE
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, config: config}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if len(s.records) > 0 {
+		slog.Logf(logger.Levels.Info, "Spool %s has %d unacked batches", dir, len(s.records))
+	}
+	return s, nil
+}
+
+func (s *Spool) load() error {
+	if err := s.loadSession(); err != nil {
+		return err
+	}
+	acked, err := s.readAck()
+	if err != nil {
+		return err
+	}
+	s.ackedId = acked
+	s.nextId = acked + 1
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+SPOOL_SEGMENT_SUFFIX))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), SPOOL_SEGMENT_SUFFIX), 10, 64)
+		if err != nil {
+			slog.Logf(logger.Levels.Warn, "Ignoring file %s in spool", name)
+			continue
+		}
+		seg := &spoolSegment{first: first}
+		if err := s.loadSegment(seg); err != nil {
+			return err
+		}
+		last := seg.first + uint64(seg.count) - 1
+		if seg.count == 0 || last <= acked {
+			if err := os.Remove(s.segmentPath(seg)); err != nil {
+				return err
+			}
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.nextId = last + 1
+	}
+
+	if len(s.segments) > 0 {
+		seg := s.segments[len(s.segments)-1]
+		if seg.size < s.config.SegmentSize {
+			s.file, err = os.OpenFile(s.segmentPath(seg), os.O_WRONLY|os.O_APPEND, 0644)
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSegment reads the records of seg, keeping the unacked ones
+func (s *Spool) loadSegment(seg *spoolSegment) error {
+	path := s.segmentPath(seg)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, spoolHeaderSize)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if err != io.EOF {
+				return s.truncate(path, offset, err)
+			}
+			break
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		//a record can be larger than SegmentSize, but not than what is left of the file
+		if int64(length) > info.Size()-offset-spoolHeaderSize {
+			return s.truncate(path, offset, fmt.Errorf("Record length %d past the end of the segment", length))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return s.truncate(path, offset, err)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			return s.truncate(path, offset, errors.New("Checksum mismatch"))
+		}
+
+		id := seg.first + uint64(seg.count)
+		seg.count++
+		if id > s.ackedId {
+			s.records = append(s.records, spoolRecord{id, seg, offset + spoolHeaderSize, int(length)})
+			s.bytes += int64(length)
+		}
+		offset += spoolHeaderSize + int64(length)
+		seg.size = offset
+	}
+	return nil
+}
+
+func (s *Spool) truncate(path string, offset int64, cause error) error {
+	slog.Logf(logger.Levels.Warn, "Truncating spool segment %s at %d: %v", path, offset, cause)
+	return os.Truncate(path, offset)
+}
+
+func (s *Spool) segmentPath(seg *spoolSegment) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seg.first, SPOOL_SEGMENT_SUFFIX))
+}
+
+// loadSession reads the session of the spool, starting a new one the first time
+func (s *Spool) loadSession() error {
+	path := filepath.Join(s.dir, SPOOL_SESSION_FILE)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.session = NewSessionId()
+		return os.WriteFile(path, s.session[:], 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) != len(s.session) {
+		return fmt.Errorf("Corrupt spool session file, %d bytes", len(b))
+	}
+	copy(s.session[:], b)
+	return nil
+}
+
+func (s *Spool) Session() SessionId {
+	return s.session
+}
+
+func (s *Spool) readAck() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, SPOOL_ACK_FILE))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("Corrupt spool ack file, %d bytes", len(b))
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// writeAck replaces the ack file, through a rename so that a crash leaves either the old or the new one
+func (s *Spool) writeAck() error {
+	path := filepath.Join(s.dir, SPOOL_ACK_FILE)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, s.ackedId)
+	if _, err = f.Write(b); err == nil && s.config.Sync == SYNC_ALWAYS {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *Spool) CanAdd() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.config.MaxItems > 0 && len(s.records) >= s.config.MaxItems {
+		return false
+	}
+	return s.config.MaxBytes <= 0 || s.bytes < s.config.MaxBytes
+}
+
+// Add appends payload to the last segment, starting a new one when it is full
+func (s *Spool) Add(payload []byte) (seq int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, ErrSpoolClosed
+	}
+	if (s.config.MaxItems > 0 && len(s.records) >= s.config.MaxItems) ||
+		(s.config.MaxBytes > 0 && s.bytes >= s.config.MaxBytes) {
+		return 0, ErrSpoolFull
+	}
+
+	seg := s.lastSegment()
+	if s.file == nil || seg.size >= s.config.SegmentSize {
+		if seg, err = s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolHeaderSize:], payload)
+	if _, err = s.file.Write(record); err == nil && s.config.Sync == SYNC_ALWAYS {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		//drop what was written so that the next record starts at the right offset
+		s.file.Truncate(seg.size)
+		return 0, err
+	}
+
+	s.records = append(s.records, spoolRecord{s.nextId, seg, seg.size + spoolHeaderSize, len(payload)})
+	s.bytes += int64(len(payload))
+	seg.size += int64(len(record))
+	seg.count++
+	s.nextId++
+	return int(s.nextId - 1), nil
+}
+
+func (s *Spool) lastSegment() *spoolSegment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+// rotate closes the last segment and starts a new one with the next id
+func (s *Spool) rotate() (*spoolSegment, error) {
+	if err := s.closeFile(); err != nil {
+		return nil, err
+	}
+	seg := &spoolSegment{first: s.nextId}
+	f, err := os.OpenFile(s.segmentPath(seg), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+func (s *Spool) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	var err error
+	if s.config.Sync != SYNC_NONE {
+		err = s.file.Sync()
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+// Ack drops the batches up to seq, persists the ack and deletes the segments that were fully acked.
+// Failing to persist the ack is logged: the batches would be sent again after a restart.
+func (s *Spool) Ack(seq int) (uint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if seq < 0 || uint64(seq) >= s.nextId {
+		return 0, util.ErrAckNotSent
+	}
+	count := uint(0)
+	for len(s.records) > 0 && s.records[0].id <= uint64(seq) {
+		s.ackedId = s.records[0].id
+		s.bytes -= int64(s.records[0].length)
+		s.records = s.records[1:]
+		count++
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	if err := s.writeAck(); err != nil {
+		slog.Logf(logger.Levels.Error, "Could not persist ack of spool %s: %v", s.dir, err)
+		return count, nil
+	}
+
+	for len(s.segments) > 1 && s.segments[0].first+uint64(s.segments[0].count)-1 <= s.ackedId {
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil {
+			slog.Logf(logger.Levels.Error, "Could not delete spool segment: %v", err)
+			break
+		}
+		s.segments = s.segments[1:]
+	}
+	return count, nil
+}
+
+// Acked is the id preceding the first unacked batch, which follows the last acked one unless batches were
+// dropped
+func (s *Spool) Acked() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.records) > 0 {
+		return int(s.records[0].id - 1)
+	}
+	return int(s.ackedId)
+}
+
+func (s *Spool) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.records)
+}
+
+// Bytes is the size of the payloads of the unacked batches
+func (s *Spool) Bytes() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bytes
+}
+
+// Reset reads the unacked batches back from disk, in order. The unreadable ones are dropped, leaving gaps
+// in the sequence numbers.
+func (s *Spool) Reset() []util.Unacked {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]util.Unacked, 0, len(s.records))
+	kept := make([]spoolRecord, 0, len(s.records))
+	files := make(map[*spoolSegment]*os.File) //nil for the segments that could not be opened
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for _, r := range s.records {
+		f, ok := files[r.segment]
+		if !ok {
+			var err error
+			if f, err = os.Open(s.segmentPath(r.segment)); err != nil {
+				slog.Logf(logger.Levels.Error, "Could not read spool segment: %v", err)
+				f = nil
+			}
+			files[r.segment] = f
+		}
+		if f == nil {
+			continue
+		}
+		payload := make([]byte, r.length)
+		if _, err := f.ReadAt(payload, r.offset); err != nil {
+			slog.Logf(logger.Levels.Error, "Could not read batch %d of spool segment: %v", r.id, err)
+			continue
+		}
+		ret = append(ret, util.Unacked{Seq: int(r.id), Payload: payload})
+		kept = append(kept, r)
+	}
+
+	if len(kept) < len(s.records) {
+		slog.Logf(logger.Levels.Error, "Dropping %d unreadable batches of spool %s", len(s.records)-len(kept), s.dir)
+		s.bytes = 0
+		for _, r := range kept {
+			s.bytes += int64(r.length)
+		}
+		s.records = kept
+	}
+	return ret
+}
+
+// Close syncs and closes the last segment, the spool can be opened again with OpenSpool
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return s.closeFile()
+}
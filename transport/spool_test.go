@@ -0,0 +1,357 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"github.com/cloudflare/go-stream/stream"
+	"github.com/cloudflare/go-stream/util"
+	"sync"
+	"testing"
+	"time"
+)
+
+func segmentFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+SPOOL_SEGMENT_SUFFIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func checkReset(t *testing.T, s *Spool, first int, last int) {
+	leftover := s.Reset()
+	if len(leftover) != last-first+1 {
+		t.Fatalf("Expected %d batches, got %d", last-first+1, len(leftover))
+	}
+	for i, b := range leftover {
+		if string(b.Payload) != fmt.Sprintf("batch %d", first+i) || b.Seq != first+i+1 {
+			t.Errorf("Wrong batch %d: %d %s", i, b.Seq, b.Payload)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, SpoolConfig{SegmentSize: 30, Sync: SYNC_ALWAYS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		seq, err := s.Add([]byte(fmt.Sprintf("batch %d", i)))
+		if err != nil || seq != i+1 {
+			t.Fatal("Add failed", seq, err)
+		}
+	}
+	if n := len(segmentFiles(t, dir)); n != 5 {
+		t.Error("Expected 5 segments of 2 batches, got", n)
+	}
+	if cnt, err := s.Ack(5); err != nil || cnt != 5 {
+		t.Error("Wrong ack count", cnt, err)
+	}
+	if n := len(segmentFiles(t, dir)); n != 3 {
+		t.Error("Acked segments should be deleted, got", n)
+	}
+	s.Close()
+
+	s, err = OpenSpool(dir, SpoolConfig{SegmentSize: 30, Sync: SYNC_ALWAYS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 5 {
+		t.Fatal("Expected 5 unacked batches after reopening, got", s.Len())
+	}
+	if s.Acked() != 5 {
+		t.Error("Wrong acked seq", s.Acked())
+	}
+	checkReset(t, s, 5, 9)
+
+	//sequence numbers go on after a restart
+	if seq, _ := s.Add([]byte("batch 10")); seq != 11 {
+		t.Error("Wrong seq", seq)
+	}
+	s.Ack(7)
+	session := s.Session()
+	s.Close()
+
+	s, err = OpenSpool(dir, SpoolConfig{SegmentSize: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Session() != session {
+		t.Error("The session should be kept")
+	}
+	checkReset(t, s, 7, 10)
+	s.Ack(11)
+	if s.Len() != 0 || s.Bytes() != 0 {
+		t.Error("Spool should be empty", s.Len(), s.Bytes())
+	}
+	if cnt, err := s.Ack(12); err != util.ErrAckNotSent || cnt != 0 {
+		t.Error("Ack of a batch that was not added should fail", cnt, err)
+	}
+	s.Close()
+}
+
+func TestSpoolCaps(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), SpoolConfig{MaxItems: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		if !s.CanAdd() {
+			t.Fatal("Should have room")
+		}
+		s.Add([]byte("batch"))
+	}
+	if s.CanAdd() {
+		t.Error("Spool should be full")
+	}
+	if _, err := s.Add([]byte("batch")); err != ErrSpoolFull {
+		t.Error("Expected ErrSpoolFull, got", err)
+	}
+	s.Ack(1)
+	if !s.CanAdd() {
+		t.Error("Acks should make room")
+	}
+
+	b, err := OpenSpool(t.TempDir(), SpoolConfig{MaxBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Add([]byte("0123456789"))
+	if b.CanAdd() {
+		t.Error("Spool should be full")
+	}
+}
+
+func TestSpoolTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, SpoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.Add([]byte(fmt.Sprintf("batch %d", i)))
+	}
+	s.Close()
+
+	//a crash in the middle of a write
+	segments := segmentFiles(t, dir)
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, 'b', 'a'})
+	f.Close()
+
+	s, err = OpenSpool(dir, SpoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add([]byte("batch 3"))
+	s.Close()
+
+	s, err = OpenSpool(dir, SpoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkReset(t, s, 0, 3)
+}
+
+func TestSpoolCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, SpoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.Add([]byte(fmt.Sprintf("batch %d", i)))
+	}
+	s.Close()
+
+	segments := segmentFiles(t, dir)
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0xf0, 0xff, 0xff, 0xff, 1, 2, 3, 4, 'b', 'a'})
+	f.Close()
+
+	s, err = OpenSpool(dir, SpoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkReset(t, s, 0, 2)
+	if truncated, err := os.Stat(segments[0]); err != nil || truncated.Size() != info.Size() {
+		t.Error("The record should be truncated", err)
+	}
+}
+
+func TestSpoolGap(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, SpoolConfig{SegmentSize: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		s.Add([]byte(fmt.Sprintf("batch %d", i)))
+	}
+	s.Close()
+
+	//corrupt the last batch of the middle segment, which is truncated there
+	segments := segmentFiles(t, dir)
+	f, err := os.OpenFile(segments[1], os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'x'}, int64(2*spoolHeaderSize+len("batch 2")))
+	f.Close()
+
+	s, err = OpenSpool(dir, SpoolConfig{SegmentSize: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	leftover := s.Reset()
+	expected := []int{0, 1, 2, 4, 5}
+	if len(leftover) != len(expected) {
+		t.Fatal("Expected 5 batches, got", len(leftover))
+	}
+	for i, b := range leftover {
+		if string(b.Payload) != fmt.Sprintf("batch %d", expected[i]) || b.Seq != expected[i]+1 {
+			t.Errorf("Wrong batch %d: %d %s", i, b.Seq, b.Payload)
+		}
+	}
+}
+
+func TestClientSpool(t *testing.T) {
+	addr := "127.0.0.1:4560"
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, SpoolConfig{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//no server: the batches are spooled while the client retries
+	datach := make(chan stream.Object, 100)
+	c := NewClient(addr, 5).SetBuffer(spool)
+	c.SetIn(datach)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, c)
+	for i := 0; i < 20; i++ {
+		datach <- []byte(fmt.Sprintf("batch %d", i))
+	}
+	for i := 0; spool.Len() < 20; i++ {
+		if i > 100 {
+			t.Fatal("Batches not spooled", spool.Len())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Stop()
+	wg.Wait()
+	spool.Close()
+
+	//a restarted process sends them, more than fit in the send channel of the client
+	spool, err = OpenSpool(dir, SpoolConfig{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	s := NewServer(addr, DEFAULT_HWM)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	datach = make(chan stream.Object, 100)
+	c = NewClient(addr, 5).SetBuffer(spool)
+	c.SetIn(datach)
+	StartOp(wg, c)
+	datach <- []byte("batch 20")
+
+	for i := 0; i <= 20; i++ {
+		if res := <-rcvch; string(res.([]byte)) != fmt.Sprintf("batch %d", i) {
+			t.Fatal("Wrong batch received", string(res.([]byte)))
+		}
+	}
+	for i := 0; spool.Len() > 0; i++ {
+		if i > 100 {
+			t.Fatal("Batches not acked", spool.Len())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	c.Stop()
+	s.Stop()
+	wg.Wait()
+}
+
+// failingBuffer fails to add some batches, as a spool does on disk errors
+type failingBuffer struct {
+	util.SequentialBuffer
+	failures map[int]bool //by the number of the call to Add
+	calls    int
+}
+
+func (b *failingBuffer) Add(payload []byte) (int, error) {
+	b.calls++
+	if b.failures[b.calls] {
+		return 0, errors.New("Disk error")
+	}
+	return b.SequentialBuffer.Add(payload)
+}
+
+func TestClientAckNotSent(t *testing.T) {
+	c := NewClient("127.0.0.1:4558", DEFAULT_HWM)
+	c.buf.Add([]byte("batch"))
+	var protocolErr *ProtocolError
+	if _, err := c.processAck(2); !errors.As(err, &protocolErr) || !errors.Is(err, util.ErrAckNotSent) {
+		t.Error("Ack of a batch that was not sent should be a protocol error, got ", err)
+	}
+	if progress, err := c.processAck(1); !progress || err != nil {
+		t.Error("Ack failed", progress, err)
+	}
+}
+
+func TestClientBufferFailure(t *testing.T) {
+	addr := "127.0.0.1:4565"
+	s := NewServer(addr, DEFAULT_HWM)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	waitListening(t, addr)
+
+	//the first batch fails while connected, the third twice while reconnecting
+	buf := &failingBuffer{util.NewSequentialBufferChanImpl(DEFAULT_HWM), map[int]bool{1: true, 4: true, 5: true}, 0}
+	datach := make(chan stream.Object, 100)
+	c := NewClient(addr, DEFAULT_HWM).SetBuffer(buf)
+	c.SetIn(datach)
+	StartOp(wg, c)
+	for i := 0; i < 5; i++ {
+		datach <- []byte(fmt.Sprintf("batch %d", i))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case res := <-rcvch:
+			if string(res.([]byte)) != fmt.Sprintf("batch %d", i) {
+				t.Fatal("Wrong batch received", string(res.([]byte)))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Batch lost", i)
+		}
+	}
+
+	c.Stop()
+	s.Stop()
+	wg.Wait()
+}
@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// ErrNoPeerCertificate is returned by the authorizers checking certificates for clients that did not send one
+var ErrNoPeerCertificate = errors.New("No peer certificate")
+
+// PeerAuthorizer decides whether a client may send data to a server. state is nil on plain tcp connections;
+// with TLS it is the state after the handshake, with the verified chains of the client certificate.
+type PeerAuthorizer func(addr net.Addr, state *tls.ConnectionState) error
+
+// UnauthorizedError is returned when the PeerAuthorizer of a server rejects a client
+type UnauthorizedError struct {
+	Addr net.Addr
+	Err  error
+}
+
+func (e *UnauthorizedError) Error() string {
+	return fmt.Sprintf("Peer %v not authorized: %v", e.Addr, e.Err)
+}
+
+func (e *UnauthorizedError) Unwrap() error {
+	return e.Err
+}
+
+// AllowCommonNames authorizes the clients whose verified certificate has one of the given common names
+func AllowCommonNames(names ...string) PeerAuthorizer {
+	allowed := make(map[string]bool)
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(addr net.Addr, state *tls.ConnectionState) error {
+		if state == nil || len(state.VerifiedChains) == 0 {
+			return ErrNoPeerCertificate
+		}
+		cn := state.VerifiedChains[0][0].Subject.CommonName
+		if !allowed[cn] {
+			return fmt.Errorf("Common name %q not allowed", cn)
+		}
+		return nil
+	}
+}
+
+// NewServerTLSConfig loads the certificate of a server. With clientCAFile set, clients must present a
+// certificate signed by one of its CAs.
+func NewServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientTLSConfig verifies servers against the CAs of caFile, the system ones if empty. The client
+// certificate is optional and only needed by servers requiring mutual authentication.
+func NewClientTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// handshake completes the TLS handshake of a server connection and runs the authorizer
+func handshake(conn net.Conn, authorize PeerAuthorizer) error {
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		s := tlsConn.ConnectionState()
+		state = &s
+	}
+	if authorize == nil {
+		return nil
+	}
+	if err := authorize(conn.RemoteAddr(), state); err != nil {
+		return &UnauthorizedError{conn.RemoteAddr(), err}
+	}
+	return nil
+}
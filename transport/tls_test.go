@@ -0,0 +1,253 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	metrics "github.com/rcrowley/go-metrics"
+	"os"
+	"github.com/cloudflare/go-stream/stream"
+	baseutil "github.com/cloudflare/go-stream/util"
+	"github.com/cloudflare/go-stream/util/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+const tlsTestAddr = "127.0.0.1:4559"
+
+func TestMain(m *testing.M) {
+	slog.Init(slog.DEFAULT_STATS_LOG_NAME,
+		slog.DEFAULT_STATS_LOG_LEVEL,
+		slog.DEFAULT_STATS_LOG_PREFIX,
+		baseutil.NewStreamingMetrics(metrics.NewRegistry()),
+		"", "", "")
+	os.Exit(m.Run())
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue signs a certificate for a server on 127.0.0.1 or, with server false, a client
+func (ca *testCA) issue(t *testing.T, cn string, server bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) serverConfig(t *testing.T) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "collector", true)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func (ca *testCA) clientConfig(t *testing.T, cn string, serverCA *testCA) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, cn, false)},
+		RootCAs:      serverCA.pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// waitListening waits for a server to accept connections, so that clients connect on their first try
+func waitListening(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Server not listening on", addr)
+}
+
+// recordingAuthorizer sends the result of authorize for each connection on the returned channel
+func recordingAuthorizer(authorize PeerAuthorizer) (PeerAuthorizer, chan error) {
+	results := make(chan error, 100)
+	return func(addr net.Addr, state *tls.ConnectionState) error {
+		err := authorize(addr, state)
+		results <- err
+		return err
+	}, results
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	authorize, results := recordingAuthorizer(AllowCommonNames("edge-1"))
+
+	s := NewServer(tlsTestAddr, DEFAULT_HWM).SetTLSConfig(ca.serverConfig(t)).SetAuthorizer(authorize)
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+
+	datach := make(chan stream.Object, 100)
+	c := NewClient(tlsTestAddr, DEFAULT_HWM).SetTLSConfig(ca.clientConfig(t, "edge-1", ca))
+	c.SetIn(datach)
+
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	StartOp(wg, c)
+
+	for i := 0; i < 10; i++ {
+		datach <- []byte(fmt.Sprintf("test %d", i))
+	}
+	for i := 0; i < 10; i++ {
+		if res := <-rcvch; string(res.([]byte)) != fmt.Sprintf("test %d", i) {
+			t.Error("Wrong message received", string(res.([]byte)))
+		}
+	}
+	if err := <-results; err != nil {
+		t.Error("Client should be authorized", err)
+	}
+
+	c.Stop()
+	s.Stop()
+	wg.Wait()
+}
+
+func TestTLSRejected(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	otherCA := newTestCA(t, "other ca")
+
+	tests := []struct {
+		name       string
+		client     *tls.Config
+		authorized bool //the handshake succeeds and the authorizer rejects the client
+	}{
+		{"untrusted client certificate", otherCA.clientConfig(t, "edge-1", ca), false},
+		{"common name not allowed", ca.clientConfig(t, "edge-2", ca), true},
+		{"plain tcp client", nil, false},
+	}
+
+	for _, test := range tests {
+		authorize, results := recordingAuthorizer(AllowCommonNames("edge-1"))
+		s := NewServer(tlsTestAddr, DEFAULT_HWM).SetTLSConfig(ca.serverConfig(t)).SetAuthorizer(authorize)
+		rcvch := make(chan stream.Object, 100)
+		s.SetOut(rcvch)
+
+		datach := make(chan stream.Object, 100)
+		c := NewClient(tlsTestAddr, DEFAULT_HWM).SetTLSConfig(test.client)
+		c.SetIn(datach)
+
+		wg := &sync.WaitGroup{}
+		StartOp(wg, s)
+		waitListening(t, tlsTestAddr)
+		StartOp(wg, c)
+
+		for i := 0; i < 10; i++ {
+			datach <- []byte(fmt.Sprintf("test %d", i))
+		}
+
+		select {
+		case res := <-rcvch:
+			t.Errorf("%s: server should not receive anything, got %s", test.name, res.([]byte))
+		case err := <-results:
+			if !test.authorized {
+				t.Errorf("%s: the handshake should have failed before authorizing, got %v", test.name, err)
+			} else if err == nil {
+				t.Errorf("%s: client should be rejected", test.name)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if test.authorized {
+				t.Errorf("%s: authorizer was not called", test.name)
+			}
+		}
+		if len(rcvch) != 0 {
+			t.Errorf("%s: server should not receive anything", test.name)
+		}
+
+		c.Stop()
+		s.Stop()
+		wg.Wait()
+	}
+}
+
+func TestAuthorizerPlain(t *testing.T) {
+	addrs := make(chan net.Addr, 1)
+	s := NewServer(tlsTestAddr, DEFAULT_HWM).SetAuthorizer(func(addr net.Addr, state *tls.ConnectionState) error {
+		if state != nil {
+			t.Error("State should be nil without TLS")
+		}
+		addrs <- addr
+		return nil
+	})
+	rcvch := make(chan stream.Object, 100)
+	s.SetOut(rcvch)
+
+	datach := make(chan stream.Object, 100)
+	c := NewClient(tlsTestAddr, DEFAULT_HWM)
+	c.SetIn(datach)
+
+	wg := &sync.WaitGroup{}
+	StartOp(wg, s)
+	StartOp(wg, c)
+
+	datach <- []byte("test")
+	if res := <-rcvch; string(res.([]byte)) != "test" {
+		t.Error("Wrong message received")
+	}
+	if addr := <-addrs; !addr.(*net.TCPAddr).IP.IsLoopback() {
+		t.Error("Wrong peer address", addr)
+	}
+
+	c.Stop()
+	s.Stop()
+	wg.Wait()
+}
@@ -0,0 +1,189 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	metrics "github.com/rcrowley/go-metrics"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+var summaryQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// PrometheusHandler exposes StreamingMetrics in the Prometheus text exposition format: uptime, the metrics
+// group of every op (labelled with op) and every metric of the go-metrics registry.
+type PrometheusHandler struct {
+	Metrics   *StreamingMetrics
+	Namespace string //prefix of every metric name
+	Process   string //value of the process label, may be empty
+}
+
+func NewPrometheusHandler(m *StreamingMetrics, namespace string, process string) *PrometheusHandler {
+	return &PrometheusHandler{m, namespace, process}
+}
+
+func (h *PrometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+	bw := bufio.NewWriter(w)
+	h.Write(bw)
+	bw.Flush()
+}
+
+// Write writes all the metrics in the text exposition format
+func (h *PrometheusHandler) Write(w *bufio.Writer) {
+	pw := &promWriter{w, h.Namespace, h.Process}
+
+	pw.header("uptime_seconds", "gauge", "Seconds since the metrics were created")
+	pw.sample("uptime_seconds", nil, float64(time.Now().Unix()-h.Metrics.StartTime))
+
+	groups := h.Metrics.Groups()
+	ops := make([]string, 0, len(groups))
+	for op := range groups {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	opCounters := []struct {
+		name string
+		help string
+		get  func(MetricsGroup) metrics.Counter
+	}{
+		{"op_events_total", "Events recorded by the op", func(g MetricsGroup) metrics.Counter { return g.Events }},
+		{"op_errors_total", "Errors returned by the op", func(g MetricsGroup) metrics.Counter { return g.Errors }},
+		{"op_items_in_total", "Items consumed by the op", func(g MetricsGroup) metrics.Counter { return g.In }},
+		{"op_items_out_total", "Items produced by the op", func(g MetricsGroup) metrics.Counter { return g.Out }},
+		{"op_retries_total", "Items retried by the op after an error", func(g MetricsGroup) metrics.Counter { return g.Retries }},
+		{"op_dead_letters_total", "Failed items sent to the dead letter chain of the op", func(g MetricsGroup) metrics.Counter { return g.DeadLetters }},
+	}
+	for _, c := range opCounters {
+		pw.header(c.name, "counter", c.help)
+		for _, op := range ops {
+			pw.sample(c.name, []string{"op", op}, float64(c.get(groups[op]).Count()))
+		}
+	}
+
+	pw.header("op_queue_length", "gauge", "Items waiting in the input queue of the op")
+	for _, op := range ops {
+		pw.sample("op_queue_length", []string{"op", op}, float64(groups[op].QueueLength.Value()))
+	}
+
+	opHistograms := make(map[metrics.Histogram]bool)
+	pw.header("op_latency_seconds", "summary", "Processing time of an item by the op")
+	for _, op := range ops {
+		hist := groups[op].Latency
+		opHistograms[hist] = true
+		pw.summary("op_latency_seconds", []string{"op", op}, hist.Snapshot(), float64(time.Second))
+	}
+
+	if h.Metrics.Reg == nil {
+		return
+	}
+	names := make([]string, 0)
+	all := make(map[string]interface{})
+	h.Metrics.Reg.Each(func(name string, metric interface{}) {
+		names = append(names, name)
+		all[name] = metric
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		pname := sanitizeMetricName(name)
+		switch m := all[name].(type) {
+		case metrics.Counter:
+			pw.header(pname, "counter", name)
+			pw.sample(pname, nil, float64(m.Count()))
+		case metrics.Gauge:
+			pw.header(pname, "gauge", name)
+			pw.sample(pname, nil, float64(m.Value()))
+		case metrics.GaugeFloat64:
+			pw.header(pname, "gauge", name)
+			pw.sample(pname, nil, m.Value())
+		case metrics.Meter:
+			pw.header(pname+"_total", "counter", name)
+			pw.sample(pname+"_total", nil, float64(m.Count()))
+		case metrics.Histogram:
+			if opHistograms[m] {
+				continue
+			}
+			pw.header(pname, "summary", name)
+			pw.summary(pname, nil, m.Snapshot(), 1)
+		case metrics.Timer:
+			pw.header(pname+"_seconds", "summary", name)
+			pw.summary(pname+"_seconds", nil, m.Snapshot(), float64(time.Second))
+		}
+	}
+}
+
+type promWriter struct {
+	w         *bufio.Writer
+	namespace string
+	process   string
+}
+
+func (pw *promWriter) name(name string) string {
+	if pw.namespace == "" {
+		return name
+	}
+	return pw.namespace + "_" + name
+}
+
+func (pw *promWriter) header(name string, typ string, help string) {
+	fmt.Fprintf(pw.w, "# HELP %s %s\n", pw.name(name), escapeHelp(help))
+	fmt.Fprintf(pw.w, "# TYPE %s %s\n", pw.name(name), typ)
+}
+
+// sample writes one value, labels are name/value pairs
+func (pw *promWriter) sample(name string, labels []string, value float64) {
+	if pw.process != "" {
+		labels = append([]string{"process", pw.process}, labels...)
+	}
+	pw.w.WriteString(pw.name(name))
+	if len(labels) > 0 {
+		pw.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				pw.w.WriteByte(',')
+			}
+			fmt.Fprintf(pw.w, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		pw.w.WriteByte('}')
+	}
+	fmt.Fprintf(pw.w, " %v\n", value)
+}
+
+// summary writes a histogram as a summary, dividing its values by scale
+func (pw *promWriter) summary(name string, labels []string, h interface {
+	Count() int64
+	Sum() int64
+	Percentiles([]float64) []float64
+}, scale float64) {
+	ps := h.Percentiles(summaryQuantiles)
+	for i, q := range summaryQuantiles {
+		pw.sample(name, append(append([]string{}, labels...), "quantile", fmt.Sprint(q)), ps[i]/scale)
+	}
+	pw.sample(name+"_sum", labels, float64(h.Sum())/scale)
+	pw.sample(name+"_count", labels, float64(h.Count()))
+}
+
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
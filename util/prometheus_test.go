@@ -0,0 +1,46 @@
+package util
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	m := NewStreamingMetrics(metrics.NewRegistry())
+	op := "Some \"op\""
+	g := m.Register(op)
+	m.Event(&op)
+	m.Error(&op)
+	m.Update(&op, 7)
+	g.In.Inc(3)
+	g.Retries.Inc(2)
+	g.Latency.Update(2000000000)
+	metrics.GetOrRegisterCounter("custom.count", m.Reg).Inc(5)
+
+	rec := httptest.NewRecorder()
+	NewPrometheusHandler(m, "gostream", "test").ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		"# TYPE gostream_op_events_total counter",
+		`gostream_op_events_total{process="test",op="Some \"op\""} 1`,
+		`gostream_op_errors_total{process="test",op="Some \"op\""} 1`,
+		`gostream_op_items_in_total{process="test",op="Some \"op\""} 3`,
+		`gostream_op_retries_total{process="test",op="Some \"op\""} 2`,
+		`gostream_op_dead_letters_total{process="test",op="Some \"op\""} 0`,
+		`gostream_op_queue_length{process="test",op="Some \"op\""} 7`,
+		`gostream_op_latency_seconds_sum{process="test",op="Some \"op\""} 2`,
+		`gostream_op_latency_seconds_count{process="test",op="Some \"op\""} 1`,
+		`gostream_custom_count{process="test"} 5`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("Missing line ", line, " in ", body)
+		}
+	}
+	if strings.Contains(body, "latency{") {
+		t.Error("Op latency histogram exported twice ", body)
+	}
+}
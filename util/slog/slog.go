@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/cloudflare/golog/logger"
 	zmq "github.com/pebbe/zmq3"
+	"net/http"
 	"os"
 	"github.com/cloudflare/go-stream/util"
 	"strings"
@@ -12,9 +13,10 @@ import (
 )
 
 var (
-	LogPrefix string
-	glog      *logger.Logger         // the main logger object
-	Gm        *util.StreamingMetrics // Main metrics object
+	LogPrefix   string
+	processName string
+	glog        *logger.Logger         // the main logger object
+	Gm          *util.StreamingMetrics // Main metrics object
 )
 
 const (
@@ -68,7 +70,24 @@ func Init(logName string, logLevel string, logPrefix string, metrics *util.Strea
 	}
 
 	Gm = metrics
-	go statsSender(&metricsAddr, &logPrefix)
+	processName = logPrefix
+	if metricsAddr != "" {
+		go statsSender(&metricsAddr, &logPrefix)
+	}
+}
+
+// MetricsHandler exposes Gm in the Prometheus text format. It can be served alongside the zmq
+// stats endpoint, or instead of it by passing an empty metricsAddr to Init.
+func MetricsHandler() http.Handler {
+	return util.NewPrometheusHandler(Gm, "gostream", processName)
+}
+
+// ServeMetricsHTTP serves MetricsHandler on addr at /metrics. It blocks like http.ListenAndServe.
+func ServeMetricsHTTP(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	Logf(logger.Levels.Info, "Serving metrics over http on %s", addr)
+	return http.ListenAndServe(addr, mux)
 }
 
 func Logf(level logger.Level, format string, v ...interface{}) {
@@ -111,8 +130,9 @@ func statsSender(metricsAddr *string, processName *string) {
 		} else {
 			timestamp := time.Now().Unix() - Gm.StartTime
 			dBag := statsPkg{*processName, timestamp, map[string]interface{}{}}
-			for k, v := range Gm.OpGroups {
-				dBag.OpMetrics[k] = map[string]int64{"Events": v.Events.Count(), "Errors": v.Errors.Count(), "Queue": v.QueueLength.Value()}
+			for k, v := range Gm.Groups() {
+				dBag.OpMetrics[k] = map[string]int64{"Events": v.Events.Count(), "Errors": v.Errors.Count(), "Queue": v.QueueLength.Value(),
+					"In": v.In.Count(), "Out": v.Out.Count()}
 			}
 			stats, err := json.Marshal(dBag)
 			if err == nil {
@@ -1,7 +1,9 @@
 package util
 
 import (
+	"errors"
 	metrics "github.com/rcrowley/go-metrics"
+	"sync"
 	"time"
 )
 
@@ -98,13 +100,25 @@ func (mb *InterfaceBuffer) Get(i int) interface{} {
 	return mb.buf[i]
 }
 
+// ErrAckNotSent is returned by SequentialBuffer.Ack for a sequence number that was not added yet
+var ErrAckNotSent = errors.New("Ack of a batch that was not sent")
+
+// Unacked is a batch kept by a SequentialBuffer, with the sequence number it was added with
+type Unacked struct {
+	Seq     int
+	Payload []byte
+}
+
+// SequentialBuffer keeps the sent batches until they are acked. Sequence numbers only grow, Reset returns
+// the unacked batches to be sent again with their sequence numbers, which may have gaps.
+// Ack returns the number of batches it dropped.
 type SequentialBuffer interface {
 	CanAdd() bool
 	Add(payload []byte) (seq int, err error)
-	Ack(seq int) uint
+	Ack(seq int) (uint, error)
 	//Unacked() [][]byte //guaranteed only on first call
 	Len() int
-	Reset() [][]byte
+	Reset() []Unacked
 }
 
 type SequentialBufferChanImpl struct {
@@ -130,40 +144,37 @@ func (buf *SequentialBufferChanImpl) Add(payload []byte) (seq int, err error) {
 	return
 }
 
-func (buf *SequentialBufferChanImpl) Ack(seq int) uint {
+func (buf *SequentialBufferChanImpl) Ack(seq int) (uint, error) {
 	//log.Println("Acking seq #", seq)
 	count := uint(0)
 	if buf.lastack+len(buf.chanbuf) < seq {
-		panic("Improper use")
+		return 0, ErrAckNotSent
 	}
 	for seq > buf.lastack {
 		<-buf.chanbuf
 		buf.lastack++
 		count++
 	}
-	return count
+	return count, nil
 }
 
 func (buf *SequentialBufferChanImpl) Len() int {
 	return len(buf.chanbuf)
 }
 
-func (buf *SequentialBufferChanImpl) Reset() [][]byte {
+func (buf *SequentialBufferChanImpl) Reset() []Unacked {
 	//log.Println("In reset, len of leftover is ", len(buf.chanbuf))
-	ret := make([][]byte, len(buf.chanbuf))
+	ret := make([]Unacked, len(buf.chanbuf))
 	i := 0
 	for len(buf.chanbuf) > 0 {
-		ret[i] = <-buf.chanbuf
+		ret[i] = Unacked{buf.lastack + 1 + i, <-buf.chanbuf}
 		//log.Println("In reset, index: ", i, " data:", string(ret[i]))
 		i++
 	}
 
 	for _, val := range ret {
-		buf.chanbuf <- val
+		buf.chanbuf <- val.Payload
 	}
-
-	buf.lastack = 0
-	buf.seq = len(buf.chanbuf) + 1
 	return ret
 }
 
@@ -171,28 +182,70 @@ type MetricsGroup struct {
 	Events      metrics.Counter
 	Errors      metrics.Counter
 	QueueLength metrics.Gauge
+	In          metrics.Counter
+	Out         metrics.Counter
+	Latency     metrics.Histogram // processing time of an item, in nanoseconds
+	Retries     metrics.Counter   // items processed again after an error
+	DeadLetters metrics.Counter   // failed items sent to a dead letter chain
 }
 
 type StreamingMetrics struct {
 	Reg       metrics.Registry
 	OpGroups  map[string]MetricsGroup // Each Op can have an associated metrics group
 	StartTime int64                   // How long we've been running for
+	lock      sync.RWMutex
+}
+
+func (m *StreamingMetrics) group(op string) (MetricsGroup, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	g, ok := m.OpGroups[op]
+	return g, ok
 }
 
 func (m *StreamingMetrics) Event(op *string) {
-	m.OpGroups[*op].Events.Inc(1)
+	if g, ok := m.group(*op); ok {
+		g.Events.Inc(1)
+	}
 }
 
 func (m *StreamingMetrics) Error(op *string) {
-	m.OpGroups[*op].Errors.Inc(1)
+	if g, ok := m.group(*op); ok {
+		g.Errors.Inc(1)
+	}
 }
 
 func (m *StreamingMetrics) Update(op *string, v int) {
-	m.OpGroups[*op].QueueLength.Update(int64(v))
+	if g, ok := m.group(*op); ok {
+		g.QueueLength.Update(int64(v))
+	}
 }
 
-func (m *StreamingMetrics) Register(op string) {
-	m.OpGroups[op] = MetricsGroup{metrics.NewCounter(), metrics.NewCounter(), metrics.NewGauge()}
+// Register creates the metrics group of op. Registering an op twice returns the existing group.
+func (m *StreamingMetrics) Register(op string) MetricsGroup {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if g, ok := m.OpGroups[op]; ok {
+		return g
+	}
+	latency := metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	if m.Reg != nil {
+		latency = m.Reg.GetOrRegister(op+".latency", latency).(metrics.Histogram)
+	}
+	g := MetricsGroup{metrics.NewCounter(), metrics.NewCounter(), metrics.NewGauge(), metrics.NewCounter(), metrics.NewCounter(), latency, metrics.NewCounter(), metrics.NewCounter()}
+	m.OpGroups[op] = g
+	return g
+}
+
+// Groups returns a snapshot of the registered metrics groups, safe to iterate while ops register
+func (m *StreamingMetrics) Groups() map[string]MetricsGroup {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	groups := make(map[string]MetricsGroup, len(m.OpGroups))
+	for k, v := range m.OpGroups {
+		groups[k] = v
+	}
+	return groups
 }
 
 func NewStreamingMetrics(mReg metrics.Registry) *StreamingMetrics {